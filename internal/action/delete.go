@@ -0,0 +1,57 @@
+package action
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+)
+
+// Delete removes each of plan's duplicates. Before removing anything, it checks
+// that the kept file still exists, has not changed since the plan was made,
+// and still has the plan's hash, computed with newHash. Duplicates that have
+// changed since the plan was made are not removed. Duplicates that are the
+// same file as the kept file, for example the same path reached through
+// overlapping roots, are never removed.
+func Delete(plan *Plan, newHash func() hash.Hash) error {
+	if err := plan.Keep.checkUnchanged(); err != nil {
+		return err
+	}
+	if err := plan.Keep.checkHash(plan.Hash, newHash); err != nil {
+		return err
+	}
+	var errs []error
+	for _, duplicate := range plan.Duplicates {
+		if plan.Keep.sameFile(duplicate) {
+			continue
+		}
+		if err := duplicate.checkUnchanged(); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if err := os.Remove(duplicate.Path); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// checkHash returns an error if the hash of f's contents, computed with
+// newHash and encoded in hex, is not expectedHash.
+func (f File) checkHash(expectedHash string, newHash func() hash.Hash) error {
+	file, err := os.Open(f.Path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	hash := newHash()
+	if _, err := io.Copy(hash, file); err != nil {
+		return err
+	}
+	if hex.EncodeToString(hash.Sum(nil)) != expectedHash {
+		return fmt.Errorf("%s: %w", f.Path, ErrChanged)
+	}
+	return nil
+}
@@ -0,0 +1,103 @@
+package action_test
+
+import (
+	"crypto/sha256"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/alecthomas/assert/v2"
+	"github.com/twpayne/go-vfs/v5/vfst"
+
+	"github.com/twpayne/find-duplicates/internal/action"
+)
+
+func TestDelete(t *testing.T) {
+	fs, cleanup, err := vfst.NewTestFS(map[string]any{
+		"alpha": "a",
+		"beta":  "a",
+		"gamma": "a",
+	})
+	assert.NoError(t, err)
+	defer cleanup()
+
+	alpha := filepath.Join(fs.TempDir(), "alpha")
+	beta := filepath.Join(fs.TempDir(), "beta")
+	gamma := filepath.Join(fs.TempDir(), "gamma")
+	hash := "ca978112ca1bbdcafac231b39a23dc4da786eff8147c4e72b9807785afee48bb"
+
+	plan := action.NewPlan(hash, statFiles(t, alpha, beta, gamma), action.KeepFirst)
+	assert.NoError(t, action.Delete(plan, sha256.New))
+
+	_, err = os.Stat(alpha)
+	assert.NoError(t, err)
+	for _, path := range []string{beta, gamma} {
+		_, err := os.Stat(path)
+		assert.IsError(t, err, os.ErrNotExist)
+	}
+}
+
+func TestDeleteKeepChanged(t *testing.T) {
+	fs, cleanup, err := vfst.NewTestFS(map[string]any{
+		"alpha": "a",
+		"beta":  "a",
+	})
+	assert.NoError(t, err)
+	defer cleanup()
+
+	alpha := filepath.Join(fs.TempDir(), "alpha")
+	beta := filepath.Join(fs.TempDir(), "beta")
+
+	plan := action.NewPlan("0000", statFiles(t, alpha, beta), action.KeepFirst)
+	assert.IsError(t, action.Delete(plan, sha256.New), action.ErrChanged)
+
+	plan = action.NewPlan("ca978112ca1bbdcafac231b39a23dc4da786eff8147c4e72b9807785afee48bb", statFiles(t, alpha, beta), action.KeepFirst)
+	assert.NoError(t, os.Remove(alpha))
+	assert.IsError(t, action.Delete(plan, sha256.New), os.ErrNotExist)
+
+	_, err = os.Stat(beta)
+	assert.NoError(t, err)
+}
+
+func TestDeleteDuplicateChangedBeforePlan(t *testing.T) {
+	fs, cleanup, err := vfst.NewTestFS(map[string]any{
+		"alpha": "a",
+		"beta":  "a",
+	})
+	assert.NoError(t, err)
+	defer cleanup()
+
+	alpha := filepath.Join(fs.TempDir(), "alpha")
+	beta := filepath.Join(fs.TempDir(), "beta")
+
+	// beta changes after it was hashed but before the plan is made.
+	files := statFiles(t, alpha, beta)
+	assert.NoError(t, os.WriteFile(beta, []byte("b"), 0o666))
+	modTime := time.Now().Add(time.Hour)
+	assert.NoError(t, os.Chtimes(beta, modTime, modTime))
+	plan := action.NewPlan("ca978112ca1bbdcafac231b39a23dc4da786eff8147c4e72b9807785afee48bb", files, action.KeepFirst)
+	assert.IsError(t, action.Delete(plan, sha256.New), action.ErrChanged)
+
+	contents, err := os.ReadFile(beta)
+	assert.NoError(t, err)
+	assert.Equal(t, "b", string(contents))
+}
+
+func TestDeleteOverlappingRoots(t *testing.T) {
+	fs, cleanup, err := vfst.NewTestFS(map[string]any{
+		"archive": map[string]any{
+			"x": "a",
+		},
+	})
+	assert.NoError(t, err)
+	defer cleanup()
+	t.Chdir(fs.TempDir())
+
+	// The same file reached through the overlapping roots . and archive.
+	plan := action.NewPlan("ca978112ca1bbdcafac231b39a23dc4da786eff8147c4e72b9807785afee48bb", statFiles(t, "./archive/x", "archive/x"), action.KeepFirst)
+	assert.NoError(t, action.Delete(plan, sha256.New))
+
+	_, err = os.Stat(filepath.Join(fs.TempDir(), "archive", "x"))
+	assert.NoError(t, err)
+}
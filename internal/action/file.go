@@ -0,0 +1,65 @@
+// Package action implements actions on groups of duplicate files.
+package action
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"time"
+)
+
+// Errors.
+var (
+	ErrChanged      = errors.New("changed")
+	ErrCrossDevice  = errors.New("on a different filesystem")
+	ErrNoReferences = errors.New("no references")
+	ErrNotRegular   = errors.New("not a regular file")
+)
+
+// A File is a regular file, as observed at a particular time.
+type File struct {
+	Path    string      `json:"path"`
+	Size    int64       `json:"size"`
+	Mode    fs.FileMode `json:"mode"`
+	ModTime time.Time   `json:"modTime"`
+	Dev     uint64      `json:"-"`
+	Ino     uint64      `json:"-"`
+}
+
+// StatFile returns the [File] at path.
+func StatFile(path string) (File, error) {
+	fileInfo, err := os.Lstat(path)
+	if err != nil {
+		return File{}, err
+	}
+	if !fileInfo.Mode().IsRegular() {
+		return File{}, &fs.PathError{Op: "stat", Path: path, Err: ErrNotRegular}
+	}
+	dev, ino := devIno(fileInfo)
+	return File{
+		Path:    path,
+		Size:    fileInfo.Size(),
+		Mode:    fileInfo.Mode(),
+		ModTime: fileInfo.ModTime(),
+		Dev:     dev,
+		Ino:     ino,
+	}, nil
+}
+
+// checkUnchanged returns an error if f has changed since it was observed.
+func (f File) checkUnchanged() error {
+	current, err := StatFile(f.Path)
+	if err != nil {
+		return err
+	}
+	if current.Size != f.Size || !current.ModTime.Equal(f.ModTime) || current.Ino != f.Ino || current.Dev != f.Dev {
+		return fmt.Errorf("%s: %w", f.Path, ErrChanged)
+	}
+	return nil
+}
+
+// sameFile returns whether f and other are the same underlying file.
+func (f File) sameFile(other File) bool {
+	return f.Ino != 0 && f.Dev == other.Dev && f.Ino == other.Ino
+}
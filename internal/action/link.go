@@ -0,0 +1,68 @@
+package action
+
+import (
+	"errors"
+	"fmt"
+	"hash"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// Link replaces each of plan's duplicates with a hard link to the kept file.
+// Each replacement is atomic: a hard link is created with a temporary name in
+// the same directory and then renamed over the original. Before replacing
+// anything, it checks that the kept file has not changed since it was found
+// and still has the plan's hash, computed with newHash. Files on a different
+// filesystem to the kept file, and files that have changed since they were
+// found, are not replaced.
+func Link(plan *Plan, newHash func() hash.Hash) error {
+	if err := plan.Keep.checkUnchanged(); err != nil {
+		return err
+	}
+	if err := plan.Keep.checkHash(plan.Hash, newHash); err != nil {
+		return err
+	}
+	var errs []error
+	for _, replace := range plan.Duplicates {
+		if err := link(plan.Keep, replace); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// link atomically replaces replace with a hard link to keep.
+func link(keep, replace File) error {
+	switch {
+	case keep.sameFile(replace):
+		return nil
+	case keep.Dev != replace.Dev:
+		return fmt.Errorf("%s: %w", replace.Path, ErrCrossDevice)
+	case keep.Size != replace.Size:
+		return fmt.Errorf("%s: %w", replace.Path, ErrChanged)
+	}
+
+	tempPath := tempPath(replace.Path)
+	if err := os.Link(keep.Path, tempPath); err != nil {
+		return err
+	}
+	defer os.Remove(tempPath)
+
+	// Check that neither file has been modified as late as possible.
+	if err := keep.checkUnchanged(); err != nil {
+		return err
+	}
+	if err := replace.checkUnchanged(); err != nil {
+		return err
+	}
+	return os.Rename(tempPath, replace.Path)
+}
+
+// tempPath returns a temporary path in the same directory as path.
+func tempPath(path string) string {
+	dir, base := filepath.Split(path)
+	suffix := strconv.FormatInt(time.Now().UnixNano(), 36)
+	return filepath.Join(dir, "."+base+".find-duplicates-"+suffix)
+}
@@ -0,0 +1,95 @@
+package action_test
+
+import (
+	"crypto/sha256"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/alecthomas/assert/v2"
+	"github.com/twpayne/go-vfs/v5/vfst"
+
+	"github.com/twpayne/find-duplicates/internal/action"
+)
+
+func TestLink(t *testing.T) {
+	fs, cleanup, err := vfst.NewTestFS(map[string]any{
+		"alpha": "a",
+		"beta":  "a",
+		"dir": map[string]any{
+			"gamma": "a",
+		},
+	})
+	assert.NoError(t, err)
+	defer cleanup()
+
+	alpha := filepath.Join(fs.TempDir(), "alpha")
+	beta := filepath.Join(fs.TempDir(), "beta")
+	gamma := filepath.Join(fs.TempDir(), "dir", "gamma")
+	plan := action.NewPlan("ca978112ca1bbdcafac231b39a23dc4da786eff8147c4e72b9807785afee48bb", statFiles(t, alpha, beta, gamma), action.KeepFirst)
+	assert.NoError(t, action.Link(plan, sha256.New))
+
+	alphaFile, err := action.StatFile(alpha)
+	assert.NoError(t, err)
+	for _, path := range []string{beta, gamma} {
+		file, err := action.StatFile(path)
+		assert.NoError(t, err)
+		assert.Equal(t, alphaFile.Ino, file.Ino)
+		contents, err := os.ReadFile(path)
+		assert.NoError(t, err)
+		assert.Equal(t, "a", string(contents))
+	}
+
+	dirEntries, err := os.ReadDir(filepath.Join(fs.TempDir(), "dir"))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(dirEntries))
+
+	// Linking again is a no-op.
+	plan = action.NewPlan("ca978112ca1bbdcafac231b39a23dc4da786eff8147c4e72b9807785afee48bb", statFiles(t, alpha, beta, gamma), action.KeepFirst)
+	assert.NoError(t, action.Link(plan, sha256.New))
+}
+
+func TestLinkChanged(t *testing.T) {
+	fs, cleanup, err := vfst.NewTestFS(map[string]any{
+		"alpha": "a",
+		"beta":  "aa",
+	})
+	assert.NoError(t, err)
+	defer cleanup()
+
+	alpha := filepath.Join(fs.TempDir(), "alpha")
+	beta := filepath.Join(fs.TempDir(), "beta")
+	plan := action.NewPlan("ca978112ca1bbdcafac231b39a23dc4da786eff8147c4e72b9807785afee48bb", statFiles(t, alpha, beta), action.KeepFirst)
+	assert.IsError(t, action.Link(plan, sha256.New), action.ErrChanged)
+
+	contents, err := os.ReadFile(beta)
+	assert.NoError(t, err)
+	assert.Equal(t, "aa", string(contents))
+}
+
+func TestLinkKeepChanged(t *testing.T) {
+	fs, cleanup, err := vfst.NewTestFS(map[string]any{
+		"alpha": "a",
+		"beta":  "a",
+	})
+	assert.NoError(t, err)
+	defer cleanup()
+
+	alpha := filepath.Join(fs.TempDir(), "alpha")
+	beta := filepath.Join(fs.TempDir(), "beta")
+	plan := action.NewPlan("ca978112ca1bbdcafac231b39a23dc4da786eff8147c4e72b9807785afee48bb", statFiles(t, alpha, beta), action.KeepFirst)
+
+	// alpha's contents change after it was hashed, but its metadata does not.
+	assert.NoError(t, os.WriteFile(alpha, []byte("b"), 0o666))
+	assert.NoError(t, os.Chtimes(alpha, plan.Keep.ModTime, plan.Keep.ModTime))
+	assert.IsError(t, action.Link(plan, sha256.New), action.ErrChanged)
+
+	alphaFile, err := action.StatFile(alpha)
+	assert.NoError(t, err)
+	betaFile, err := action.StatFile(beta)
+	assert.NoError(t, err)
+	assert.NotEqual(t, alphaFile.Ino, betaFile.Ino)
+	contents, err := os.ReadFile(beta)
+	assert.NoError(t, err)
+	assert.Equal(t, "a", string(contents))
+}
@@ -0,0 +1,232 @@
+package action
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"syscall"
+	"time"
+)
+
+// ErrConflict is returned when a move cannot be undone.
+var ErrConflict = errors.New("conflict")
+
+// A JournalEntry records a file moved by [Move]. Paths are absolute so that
+// moves can be undone from any directory.
+type JournalEntry struct {
+	OriginalPath string      `json:"originalPath"`
+	NewPath      string      `json:"newPath"`
+	Hash         string      `json:"hash"`
+	Mode         fs.FileMode `json:"mode"`
+	ModTime      time.Time   `json:"modTime"`
+}
+
+// A Journal records moves as JSON lines, one per move.
+type Journal struct {
+	file    *os.File
+	encoder *json.Encoder
+}
+
+// CreateJournal creates a new journal in the file name.
+func CreateJournal(name string) (*Journal, error) {
+	file, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o666)
+	if err != nil {
+		return nil, err
+	}
+	return &Journal{
+		file:    file,
+		encoder: json.NewEncoder(file),
+	}, nil
+}
+
+// Close closes j.
+func (j *Journal) Close() error {
+	return j.file.Close()
+}
+
+// record records entry in j. The journal is synced after each entry so that
+// moves are recorded even if the process is interrupted.
+func (j *Journal) record(entry *JournalEntry) error {
+	if err := j.encoder.Encode(entry); err != nil {
+		return err
+	}
+	return j.file.Sync()
+}
+
+// Move moves each of plan's duplicates into the directory dir, preserving
+// their paths, and records each move in journal. Each move is recorded before
+// it is made, so that it can be undone even if the process is interrupted.
+// Before moving anything, it checks that the kept file has not changed since
+// it was found and still has the plan's hash, computed with newHash.
+// Duplicates that have changed since they were found are not moved.
+// Duplicates that are the same file as the kept file, for example the same
+// path reached through overlapping roots, are never moved.
+func Move(plan *Plan, dir string, journal *Journal, newHash func() hash.Hash) error {
+	if err := plan.Keep.checkUnchanged(); err != nil {
+		return err
+	}
+	if err := plan.Keep.checkHash(plan.Hash, newHash); err != nil {
+		return err
+	}
+	var errs []error
+	for _, duplicate := range plan.Duplicates {
+		if plan.Keep.sameFile(duplicate) {
+			continue
+		}
+		if err := move(plan.Hash, duplicate, dir, journal); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Undo undoes the moves recorded in the journal read from r, in reverse order.
+// Moves that were recorded but never made are skipped. Moves that cannot be
+// undone, because the original path exists again or the moved file is missing
+// or has been modified, are reported as conflicts and skipped.
+func Undo(r io.Reader) error {
+	var entries []*JournalEntry
+	decoder := json.NewDecoder(bufio.NewReader(r))
+	for {
+		var entry JournalEntry
+		err := decoder.Decode(&entry)
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return err
+		}
+		entries = append(entries, &entry)
+	}
+
+	var errs []error
+	for _, entry := range slices.Backward(entries) {
+		if err := undo(entry); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// move records the move of file into dir in journal and then moves it.
+func move(hash string, file File, dir string, journal *Journal) error {
+	originalPath, err := filepath.Abs(file.Path)
+	if err != nil {
+		return err
+	}
+	newPath, err := quarantinePath(dir, file.Path)
+	if err != nil {
+		return err
+	}
+	if newPath, err = filepath.Abs(newPath); err != nil {
+		return err
+	}
+	if _, err := os.Lstat(newPath); err == nil {
+		return fmt.Errorf("%s: %w", newPath, fs.ErrExist)
+	}
+	if err := os.MkdirAll(filepath.Dir(newPath), 0o777); err != nil {
+		return err
+	}
+	if err := file.checkUnchanged(); err != nil {
+		return err
+	}
+	if err := journal.record(&JournalEntry{
+		OriginalPath: originalPath,
+		NewPath:      newPath,
+		Hash:         hash,
+		Mode:         file.Mode,
+		ModTime:      file.ModTime,
+	}); err != nil {
+		return err
+	}
+	return renameOrCopy(originalPath, newPath, file.Mode, file.ModTime)
+}
+
+// quarantinePath returns the path in dir for path.
+func quarantinePath(dir, path string) (string, error) {
+	if filepath.IsLocal(path) {
+		return filepath.Join(dir, path), nil
+	}
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, absPath[len(filepath.VolumeName(absPath)):]), nil
+}
+
+// renameOrCopy renames oldPath to newPath. If oldPath and newPath are on
+// different filesystems then it copies oldPath to newPath, preserving its mode
+// and modification time, and then removes oldPath.
+func renameOrCopy(oldPath, newPath string, mode fs.FileMode, modTime time.Time) error {
+	err := os.Rename(oldPath, newPath)
+	if !errors.Is(err, syscall.EXDEV) {
+		return err
+	}
+	if err := copyFile(oldPath, newPath, mode, modTime); err != nil {
+		return err
+	}
+	return os.Remove(oldPath)
+}
+
+// copyFile copies oldPath to newPath, which must not exist, and sets its mode
+// and modification time.
+func copyFile(oldPath, newPath string, mode fs.FileMode, modTime time.Time) error {
+	oldFile, err := os.Open(oldPath)
+	if err != nil {
+		return err
+	}
+	defer oldFile.Close()
+	newFile, err := os.OpenFile(newPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, mode.Perm())
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(newFile, oldFile)
+	if err == nil {
+		err = newFile.Sync()
+	}
+	if closeErr := newFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(newPath, mode.Perm())
+	}
+	if err == nil {
+		err = os.Chtimes(newPath, modTime, modTime)
+	}
+	if err != nil {
+		os.Remove(newPath)
+		return err
+	}
+	return nil
+}
+
+// undo undoes the move recorded in entry.
+func undo(entry *JournalEntry) error {
+	_, originalErr := os.Lstat(entry.OriginalPath)
+	fileInfo, err := os.Lstat(entry.NewPath)
+	switch {
+	case originalErr == nil && errors.Is(err, fs.ErrNotExist):
+		// The move was recorded but never made.
+		return nil
+	case originalErr == nil:
+		return fmt.Errorf("%s: %w: %w", entry.OriginalPath, ErrConflict, fs.ErrExist)
+	case err != nil:
+		return fmt.Errorf("%s: %w: %w", entry.NewPath, ErrConflict, err)
+	}
+	if !fileInfo.ModTime().Equal(entry.ModTime) {
+		return fmt.Errorf("%s: %w: %w", entry.NewPath, ErrConflict, ErrChanged)
+	}
+	if err := os.MkdirAll(filepath.Dir(entry.OriginalPath), 0o777); err != nil {
+		return err
+	}
+	if err := renameOrCopy(entry.NewPath, entry.OriginalPath, entry.Mode, entry.ModTime); err != nil {
+		return err
+	}
+	return os.Chmod(entry.OriginalPath, entry.Mode.Perm())
+}
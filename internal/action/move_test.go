@@ -0,0 +1,172 @@
+package action_test
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/alecthomas/assert/v2"
+	"github.com/twpayne/go-vfs/v5/vfst"
+
+	"github.com/twpayne/find-duplicates/internal/action"
+)
+
+func TestMoveAndUndo(t *testing.T) {
+	fs, cleanup, err := vfst.NewTestFS(map[string]any{
+		"root": map[string]any{
+			"alpha": "a",
+			"dir": map[string]any{
+				"beta": &vfst.File{
+					Perm:     0o600,
+					Contents: []byte("a"),
+				},
+			},
+			"gamma": "a",
+		},
+	})
+	assert.NoError(t, err)
+	defer cleanup()
+
+	alpha := filepath.Join(fs.TempDir(), "root", "alpha")
+	beta := filepath.Join(fs.TempDir(), "root", "dir", "beta")
+	gamma := filepath.Join(fs.TempDir(), "root", "gamma")
+	quarantineDir := filepath.Join(fs.TempDir(), "quarantine")
+	journalPath := filepath.Join(fs.TempDir(), "journal")
+
+	plan := action.NewPlan("ca978112ca1bbdcafac231b39a23dc4da786eff8147c4e72b9807785afee48bb", statFiles(t, alpha, beta, gamma), action.KeepFirst)
+	journal, err := action.CreateJournal(journalPath)
+	assert.NoError(t, err)
+	assert.NoError(t, action.Move(plan, quarantineDir, journal, sha256.New))
+	assert.NoError(t, journal.Close())
+
+	_, err = os.Stat(alpha)
+	assert.NoError(t, err)
+	for _, path := range []string{beta, gamma} {
+		_, err := os.Stat(path)
+		assert.IsError(t, err, os.ErrNotExist)
+		contents, err := os.ReadFile(filepath.Join(quarantineDir, path))
+		assert.NoError(t, err)
+		assert.Equal(t, "a", string(contents))
+	}
+
+	// Create a conflict by recreating gamma.
+	assert.NoError(t, os.WriteFile(gamma, []byte("b"), 0o666))
+
+	journalFile, err := os.Open(journalPath)
+	assert.NoError(t, err)
+	defer journalFile.Close()
+	assert.IsError(t, action.Undo(journalFile), action.ErrConflict)
+
+	fileInfo, err := os.Stat(beta)
+	assert.NoError(t, err)
+	assert.Equal(t, 0o600, fileInfo.Mode().Perm())
+	contents, err := os.ReadFile(gamma)
+	assert.NoError(t, err)
+	assert.Equal(t, "b", string(contents))
+	_, err = os.Stat(filepath.Join(quarantineDir, gamma))
+	assert.NoError(t, err)
+}
+
+func TestMoveRelativePaths(t *testing.T) {
+	fs, cleanup, err := vfst.NewTestFS(map[string]any{
+		"root": map[string]any{
+			"alpha": "a",
+			"beta":  "a",
+		},
+	})
+	assert.NoError(t, err)
+	defer cleanup()
+	t.Chdir(fs.TempDir())
+
+	alpha := filepath.Join(fs.TempDir(), "root", "alpha")
+	beta := filepath.Join(fs.TempDir(), "root", "beta")
+	journalPath := filepath.Join(fs.TempDir(), "journal")
+
+	// ./root/alpha and root/alpha are the same file, reached through
+	// overlapping roots, so only root/beta is moved.
+	plan := action.NewPlan("ca978112ca1bbdcafac231b39a23dc4da786eff8147c4e72b9807785afee48bb", statFiles(t, "./root/alpha", "root/alpha", "root/beta"), action.KeepFirst)
+	journal, err := action.CreateJournal(journalPath)
+	assert.NoError(t, err)
+	assert.NoError(t, action.Move(plan, "quarantine", journal, sha256.New))
+	assert.NoError(t, journal.Close())
+
+	_, err = os.Stat(alpha)
+	assert.NoError(t, err)
+	_, err = os.Stat(beta)
+	assert.IsError(t, err, os.ErrNotExist)
+
+	data, err := os.ReadFile(journalPath)
+	assert.NoError(t, err)
+	var entry action.JournalEntry
+	assert.NoError(t, json.Unmarshal(data, &entry))
+	assert.Equal(t, beta, entry.OriginalPath)
+	assert.Equal(t, filepath.Join(fs.TempDir(), "quarantine", "root", "beta"), entry.NewPath)
+
+	// Undo from a different directory.
+	t.Chdir(t.TempDir())
+	journalFile, err := os.Open(journalPath)
+	assert.NoError(t, err)
+	defer journalFile.Close()
+	assert.NoError(t, action.Undo(journalFile))
+	contents, err := os.ReadFile(beta)
+	assert.NoError(t, err)
+	assert.Equal(t, "a", string(contents))
+}
+
+func TestMoveChanged(t *testing.T) {
+	fs, cleanup, err := vfst.NewTestFS(map[string]any{
+		"alpha": "a",
+		"beta":  "a",
+	})
+	assert.NoError(t, err)
+	defer cleanup()
+
+	alpha := filepath.Join(fs.TempDir(), "alpha")
+	beta := filepath.Join(fs.TempDir(), "beta")
+	quarantineDir := filepath.Join(fs.TempDir(), "quarantine")
+	journal, err := action.CreateJournal(filepath.Join(fs.TempDir(), "journal"))
+	assert.NoError(t, err)
+	defer journal.Close()
+
+	// beta changes after it was found but before the plan is made.
+	files := statFiles(t, alpha, beta)
+	modTime := time.Now().Add(time.Hour)
+	assert.NoError(t, os.Chtimes(beta, modTime, modTime))
+	plan := action.NewPlan("ca978112ca1bbdcafac231b39a23dc4da786eff8147c4e72b9807785afee48bb", files, action.KeepFirst)
+	assert.IsError(t, action.Move(plan, quarantineDir, journal, sha256.New), action.ErrChanged)
+	_, err = os.Stat(beta)
+	assert.NoError(t, err)
+
+	// alpha's contents change after it was found, but its metadata does not.
+	plan = action.NewPlan("ca978112ca1bbdcafac231b39a23dc4da786eff8147c4e72b9807785afee48bb", statFiles(t, alpha, beta), action.KeepFirst)
+	assert.NoError(t, os.WriteFile(alpha, []byte("b"), 0o666))
+	assert.NoError(t, os.Chtimes(alpha, plan.Keep.ModTime, plan.Keep.ModTime))
+	assert.IsError(t, action.Move(plan, quarantineDir, journal, sha256.New), action.ErrChanged)
+	_, err = os.Stat(beta)
+	assert.NoError(t, err)
+}
+
+func TestUndoUnmadeMove(t *testing.T) {
+	fs, cleanup, err := vfst.NewTestFS(map[string]any{
+		"alpha": "a",
+	})
+	assert.NoError(t, err)
+	defer cleanup()
+
+	// A move that was recorded but not made, for example because the process
+	// was interrupted.
+	data, err := json.Marshal(&action.JournalEntry{
+		OriginalPath: filepath.Join(fs.TempDir(), "alpha"),
+		NewPath:      filepath.Join(fs.TempDir(), "quarantine", "alpha"),
+	})
+	assert.NoError(t, err)
+	assert.NoError(t, action.Undo(bytes.NewReader(data)))
+
+	contents, err := os.ReadFile(filepath.Join(fs.TempDir(), "alpha"))
+	assert.NoError(t, err)
+	assert.Equal(t, "a", string(contents))
+}
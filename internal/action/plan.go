@@ -0,0 +1,133 @@
+package action
+
+import (
+	"cmp"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// A KeepFunc returns the index of the file to keep from files, which are
+// sorted by path.
+type KeepFunc func(files []File) int
+
+// A Plan describes which file in a group of duplicates is kept and which are
+// acted on. References are other files that are kept and never acted on.
+type Plan struct {
+	Hash       string `json:"hash"`
+	Keep       File   `json:"keep"`
+	Duplicates []File `json:"duplicates"`
+	References []File `json:"references,omitempty"`
+}
+
+// KeepFirst keeps the first file by path.
+func KeepFirst([]File) int {
+	return 0
+}
+
+// KeepNewest keeps the file with the newest modification time.
+func KeepNewest(files []File) int {
+	return minIndexFunc(files, func(a, b File) int {
+		return b.ModTime.Compare(a.ModTime)
+	})
+}
+
+// KeepOldest keeps the file with the oldest modification time.
+func KeepOldest(files []File) int {
+	return minIndexFunc(files, func(a, b File) int {
+		return a.ModTime.Compare(b.ModTime)
+	})
+}
+
+// KeepShortest keeps the file with the shortest path.
+func KeepShortest(files []File) int {
+	return minIndexFunc(files, func(a, b File) int {
+		return cmp.Compare(len(a.Path), len(b.Path))
+	})
+}
+
+// KeepFirstRoot returns a KeepFunc that keeps the file in the first of roots.
+func KeepFirstRoot(roots []string) KeepFunc {
+	return KeepPrefixes(roots)
+}
+
+// KeepPrefixes returns a KeepFunc that keeps the file that matches the first
+// of prefixes. Files that do not match any prefix are only kept if no file
+// matches.
+func KeepPrefixes(prefixes []string) KeepFunc {
+	return func(files []File) int {
+		return minIndexFunc(files, func(a, b File) int {
+			return cmp.Compare(prefixIndex(prefixes, a.Path), prefixIndex(prefixes, b.Path))
+		})
+	}
+}
+
+// NewPlan returns a new Plan for files, which all have the given hash, keeping
+// the file chosen by keepFunc. files should be as observed when they were
+// hashed, so that files that change after they were hashed are not acted on.
+func NewPlan(hash string, files []File, keepFunc KeepFunc) *Plan {
+	files = sortedFiles(files)
+	keepIndex := keepFunc(files)
+	keep := files[keepIndex]
+	return &Plan{
+		Hash:       hash,
+		Keep:       keep,
+		Duplicates: slices.Delete(files, keepIndex, keepIndex+1),
+	}
+}
+
+// NewReferencePlan returns a new Plan for files and references, which all have
+// the given hash, keeping the file in references chosen by keepFunc. Only
+// files are acted on. Like [NewPlan], files and references should be as
+// observed when they were hashed.
+func NewReferencePlan(hash string, files, references []File, keepFunc KeepFunc) (*Plan, error) {
+	if len(references) == 0 {
+		return nil, ErrNoReferences
+	}
+	references = sortedFiles(references)
+	keepIndex := keepFunc(references)
+	keep := references[keepIndex]
+	return &Plan{
+		Hash:       hash,
+		Keep:       keep,
+		Duplicates: sortedFiles(files),
+		References: slices.Delete(references, keepIndex, keepIndex+1),
+	}, nil
+}
+
+// minIndexFunc returns the index of the first minimum element of files
+// according to compare.
+func minIndexFunc(files []File, compare func(File, File) int) int {
+	minIndex := 0
+	for i := 1; i < len(files); i++ {
+		if compare(files[i], files[minIndex]) < 0 {
+			minIndex = i
+		}
+	}
+	return minIndex
+}
+
+// prefixIndex returns the index of the first prefix in prefixes that contains
+// path, or len(prefixes) if no prefix contains path.
+func prefixIndex(prefixes []string, path string) int {
+	path = filepath.Clean(path)
+	for i, prefix := range prefixes {
+		prefix = filepath.Clean(prefix)
+		switch {
+		case path == prefix:
+			return i
+		case strings.HasPrefix(path, prefix+string(filepath.Separator)):
+			return i
+		case prefix == "." && filepath.IsLocal(path):
+			return i
+		}
+	}
+	return len(prefixes)
+}
+
+// sortedFiles returns a copy of files sorted by path.
+func sortedFiles(files []File) []File {
+	return slices.SortedFunc(slices.Values(files), func(a, b File) int {
+		return strings.Compare(a.Path, b.Path)
+	})
+}
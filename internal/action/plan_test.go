@@ -0,0 +1,150 @@
+package action_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/alecthomas/assert/v2"
+	"github.com/twpayne/go-vfs/v5/vfst"
+
+	"github.com/twpayne/find-duplicates/internal/action"
+)
+
+func TestNewPlan(t *testing.T) {
+	fs, cleanup, err := vfst.NewTestFS(map[string]any{
+		"a": map[string]any{
+			"newest": "a",
+		},
+		"b": map[string]any{
+			"oldest": "a",
+		},
+		"c": map[string]any{
+			"x": map[string]any{
+				"middle": "a",
+			},
+		},
+	})
+	assert.NoError(t, err)
+	defer cleanup()
+
+	newest := filepath.Join(fs.TempDir(), "a", "newest")
+	oldest := filepath.Join(fs.TempDir(), "b", "oldest")
+	middle := filepath.Join(fs.TempDir(), "c", "x", "middle")
+	now := time.Now()
+	assert.NoError(t, os.Chtimes(newest, now, now))
+	assert.NoError(t, os.Chtimes(oldest, now.Add(-2*time.Hour), now.Add(-2*time.Hour)))
+	assert.NoError(t, os.Chtimes(middle, now.Add(-time.Hour), now.Add(-time.Hour)))
+	paths := []string{middle, oldest, newest}
+
+	for _, tc := range []struct {
+		name     string
+		keepFunc action.KeepFunc
+		expected string
+	}{
+		{
+			name:     "first",
+			keepFunc: action.KeepFirst,
+			expected: newest,
+		},
+		{
+			name:     "first_root",
+			keepFunc: action.KeepFirstRoot([]string{filepath.Join(fs.TempDir(), "c"), filepath.Join(fs.TempDir(), "b")}),
+			expected: middle,
+		},
+		{
+			name:     "newest",
+			keepFunc: action.KeepNewest,
+			expected: newest,
+		},
+		{
+			name:     "oldest",
+			keepFunc: action.KeepOldest,
+			expected: oldest,
+		},
+		{
+			name:     "prefixes",
+			keepFunc: action.KeepPrefixes([]string{filepath.Join(fs.TempDir(), "d"), filepath.Join(fs.TempDir(), "b")}),
+			expected: oldest,
+		},
+		{
+			name:     "shortest",
+			keepFunc: action.KeepShortest,
+			expected: newest,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			plan := action.NewPlan("hash", statFiles(t, paths...), tc.keepFunc)
+			assert.Equal(t, "hash", plan.Hash)
+			assert.Equal(t, tc.expected, plan.Keep.Path)
+			assert.Equal(t, 2, len(plan.Duplicates))
+			for _, duplicate := range plan.Duplicates {
+				assert.NotEqual(t, tc.expected, duplicate.Path)
+			}
+		})
+	}
+}
+
+func TestKeepPrefixesUncleanPaths(t *testing.T) {
+	files := []action.File{
+		{Path: "./x/d1/a"},
+		{Path: "./y/a"},
+	}
+	for _, prefixes := range [][]string{
+		{"./y", "./x"},
+		{"y", "x"},
+		{"y/", "./x/"},
+	} {
+		assert.Equal(t, 1, action.KeepFirstRoot(prefixes)(files))
+		assert.Equal(t, 1, action.KeepPrefixes(prefixes[:1])(files))
+	}
+}
+
+func TestNewReferencePlan(t *testing.T) {
+	fs, cleanup, err := vfst.NewTestFS(map[string]any{
+		"archive": map[string]any{
+			"a": "a",
+			"b": "a",
+		},
+		"dump": map[string]any{
+			"a": "a",
+			"c": "a",
+		},
+	})
+	assert.NoError(t, err)
+	defer cleanup()
+
+	archiveA := filepath.Join(fs.TempDir(), "archive", "a")
+	archiveB := filepath.Join(fs.TempDir(), "archive", "b")
+	dumpA := filepath.Join(fs.TempDir(), "dump", "a")
+	dumpC := filepath.Join(fs.TempDir(), "dump", "c")
+
+	// Even though the shortest path is not a reference, a reference is kept
+	// and no reference is acted on.
+	plan, err := action.NewReferencePlan("hash", statFiles(t, dumpC, dumpA), statFiles(t, archiveB, archiveA), action.KeepFirst)
+	assert.NoError(t, err)
+	assert.Equal(t, archiveA, plan.Keep.Path)
+	var duplicatePaths []string
+	for _, duplicate := range plan.Duplicates {
+		duplicatePaths = append(duplicatePaths, duplicate.Path)
+	}
+	assert.Equal(t, []string{dumpA, dumpC}, duplicatePaths)
+	assert.Equal(t, 1, len(plan.References))
+	assert.Equal(t, archiveB, plan.References[0].Path)
+
+	_, err = action.NewReferencePlan("hash", statFiles(t, dumpA, dumpC), nil, action.KeepFirst)
+	assert.IsError(t, err, action.ErrNoReferences)
+}
+
+// statFiles returns the Files at paths.
+func statFiles(t *testing.T, paths ...string) []action.File {
+	t.Helper()
+	files := make([]action.File, 0, len(paths))
+	for _, path := range paths {
+		file, err := action.StatFile(path)
+		assert.NoError(t, err)
+		files = append(files, file)
+	}
+	return files
+}
@@ -0,0 +1,69 @@
+package action
+
+import (
+	"errors"
+	"fmt"
+	"os"
+)
+
+// Reflink errors.
+var (
+	ErrContentsDiffer     = errors.New("contents differ")
+	ErrReflinkUnsupported = errors.New("reflinks not supported")
+)
+
+// Reflink makes each of plan's duplicates share storage with the kept file,
+// using the kernel's deduplication support. The kernel checks that the
+// contents are identical before sharing storage, so Reflink is safe even if
+// the duplicates were identified with a fast hash. It returns the number of
+// bytes deduplicated.
+func Reflink(plan *Plan) (int64, error) {
+	src, err := os.Open(plan.Keep.Path)
+	if err != nil {
+		return 0, err
+	}
+	defer src.Close()
+	srcFileInfo, err := src.Stat()
+	if err != nil {
+		return 0, err
+	}
+	var bytesDeduped int64
+	var errs []error
+	for _, duplicate := range plan.Duplicates {
+		n, err := reflink(src, srcFileInfo.Size(), duplicate.Path)
+		bytesDeduped += n
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return bytesDeduped, errors.Join(errs...)
+}
+
+// reflink makes the file at path share storage with the first size bytes of
+// src.
+func reflink(src *os.File, size int64, path string) (int64, error) {
+	dest, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer dest.Close()
+	destFileInfo, err := dest.Stat()
+	if err != nil {
+		return 0, err
+	}
+	srcFileInfo, err := src.Stat()
+	if err != nil {
+		return 0, err
+	}
+	switch {
+	case os.SameFile(srcFileInfo, destFileInfo):
+		return 0, nil
+	case destFileInfo.Size() != size:
+		return 0, fmt.Errorf("%s: %w", path, ErrChanged)
+	}
+	n, err := dedupeRange(src, dest, size)
+	if err != nil {
+		return n, fmt.Errorf("%s: %w", path, err)
+	}
+	return n, nil
+}
@@ -0,0 +1,52 @@
+package action
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// maxDedupeLength is the maximum length deduplicated by a single ioctl. Some
+// filesystems silently truncate larger requests.
+const maxDedupeLength = 16 << 20
+
+// dedupeRange makes the first size bytes of dest share storage with src using
+// the FIDEDUPERANGE ioctl.
+func dedupeRange(src, dest *os.File, size int64) (int64, error) {
+	var bytesDeduped int64
+	for bytesDeduped < size {
+		fileDedupeRange := &unix.FileDedupeRange{
+			Src_offset: uint64(bytesDeduped),                            //nolint:gosec
+			Src_length: uint64(min(size-bytesDeduped, maxDedupeLength)), //nolint:gosec
+			Info: []unix.FileDedupeRangeInfo{
+				{
+					Dest_fd:     int64(dest.Fd()),     //nolint:gosec
+					Dest_offset: uint64(bytesDeduped), //nolint:gosec
+				},
+			},
+		}
+		if err := unix.IoctlFileDedupeRange(int(src.Fd()), fileDedupeRange); err != nil { //nolint:gosec
+			switch {
+			case errors.Is(err, unix.EOPNOTSUPP), errors.Is(err, unix.ENOTTY), errors.Is(err, unix.EINVAL):
+				return bytesDeduped, fmt.Errorf("%w: %w", ErrReflinkUnsupported, err)
+			case errors.Is(err, unix.EXDEV):
+				return bytesDeduped, ErrCrossDevice
+			default:
+				return bytesDeduped, err
+			}
+		}
+		info := fileDedupeRange.Info[0]
+		switch {
+		case info.Status == unix.FILE_DEDUPE_RANGE_DIFFERS:
+			return bytesDeduped, ErrContentsDiffer
+		case info.Status < 0:
+			return bytesDeduped, unix.Errno(-info.Status)
+		case info.Bytes_deduped == 0:
+			return bytesDeduped, ErrReflinkUnsupported
+		}
+		bytesDeduped += int64(info.Bytes_deduped) //nolint:gosec
+	}
+	return bytesDeduped, nil
+}
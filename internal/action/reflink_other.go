@@ -0,0 +1,10 @@
+//go:build !linux
+
+package action
+
+import "os"
+
+// dedupeRange returns ErrReflinkUnsupported.
+func dedupeRange(*os.File, *os.File, int64) (int64, error) {
+	return 0, ErrReflinkUnsupported
+}
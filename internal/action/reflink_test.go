@@ -0,0 +1,38 @@
+package action_test
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/alecthomas/assert/v2"
+	"github.com/twpayne/go-vfs/v5/vfst"
+
+	"github.com/twpayne/find-duplicates/internal/action"
+)
+
+func TestReflink(t *testing.T) {
+	fs, cleanup, err := vfst.NewTestFS(map[string]any{
+		"alpha": "aaaa",
+		"beta":  "aaaa",
+		"gamma": "aaab",
+	})
+	assert.NoError(t, err)
+	defer cleanup()
+
+	alpha := filepath.Join(fs.TempDir(), "alpha")
+	beta := filepath.Join(fs.TempDir(), "beta")
+	gamma := filepath.Join(fs.TempDir(), "gamma")
+
+	plan := action.NewPlan("", statFiles(t, alpha, beta), action.KeepFirst)
+	bytesDeduped, err := action.Reflink(plan)
+	if errors.Is(err, action.ErrReflinkUnsupported) {
+		t.Skip("reflinks not supported")
+	}
+	assert.NoError(t, err)
+	assert.Equal(t, 4, bytesDeduped)
+
+	plan = action.NewPlan("", statFiles(t, alpha, gamma), action.KeepFirst)
+	_, err = action.Reflink(plan)
+	assert.IsError(t, err, action.ErrContentsDiffer)
+}
@@ -0,0 +1,11 @@
+//go:build !unix
+
+package action
+
+import "io/fs"
+
+// devIno returns the device and inode of fileInfo, or zeros if they are not
+// known.
+func devIno(fs.FileInfo) (uint64, uint64) {
+	return 0, 0
+}
@@ -0,0 +1,18 @@
+//go:build unix
+
+package action
+
+import (
+	"io/fs"
+	"syscall"
+)
+
+// devIno returns the device and inode of fileInfo, or zeros if they are not
+// known.
+func devIno(fileInfo fs.FileInfo) (uint64, uint64) {
+	stat, ok := fileInfo.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, 0
+	}
+	return uint64(stat.Dev), uint64(stat.Ino) //nolint:gosec,unconvert
+}
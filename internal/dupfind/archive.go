@@ -0,0 +1,443 @@
+package dupfind
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"slices"
+	"strings"
+)
+
+// archiveSeparator separates the path of an archive from the name of a member
+// in the archive.
+const archiveSeparator = "!/"
+
+// An archiveFormat is the format of an archive.
+type archiveFormat int
+
+// Archive formats.
+const (
+	archiveFormatZip archiveFormat = iota
+	archiveFormatTar
+	archiveFormatTarGzip
+)
+
+// archiveFormatSuffixes are the lowercase suffixes of the names of archives of
+// each format.
+var archiveFormatSuffixes = []struct {
+	suffix string
+	format archiveFormat
+}{
+	{suffix: ".zip", format: archiveFormatZip},
+	{suffix: ".tar", format: archiveFormatTar},
+	{suffix: ".tar.gz", format: archiveFormatTarGzip},
+	{suffix: ".tgz", format: archiveFormatTarGzip},
+}
+
+// An archiveMember identifies a regular file in an archive. file is the path
+// of the outermost archive, which is a regular file, and names are the names
+// of the member in each nested archive, outermost first. hashes are the hashes
+// of the member for each hash stage, computed when the archive is scanned.
+type archiveMember struct {
+	file   string
+	names  []string
+	hashes [numHashStages]string
+}
+
+// An archiveEntry is a regular file in an archive. open opens its contents,
+// which must be closed after they have been read. For tar archives, the
+// contents can only be read until the next entry is read.
+type archiveEntry struct {
+	name     string
+	fileInfo fs.FileInfo
+	open     func() (io.ReadCloser, error)
+}
+
+// An archiveReader reads the regular files in an archive. next returns io.EOF
+// after the last entry.
+type archiveReader interface {
+	next() (*archiveEntry, error)
+}
+
+// A tarArchiveReader is an archiveReader for tar archives.
+type tarArchiveReader struct {
+	tarReader *tar.Reader
+}
+
+// A zipArchiveReader is an archiveReader for zip archives.
+type zipArchiveReader struct {
+	files []*zip.File
+}
+
+// A readCloser reads from a Reader and closes a Closer.
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// A closers is an io.Closer that closes each of its Closers, last first.
+type closers []io.Closer
+
+// A memberHasher computes the hash of each hash stage of an archive member of
+// size bytes as its contents are written, so that the member is only read
+// once. The hashes cover the same bytes as the hashes of a regular file with
+// the same contents.
+type memberHasher struct {
+	blockSize int64
+	size      int64
+	written   int64
+	hashes    [numHashStages]hash.Hash
+}
+
+// WithArchiveDepth sets the maximum depth of archives whose members are found
+// as if they were regular files. Zip, tar, and gzipped tar archives are
+// recognized by their extensions. A member is found with the path of its
+// archive, an exclamation mark, and its name in the archive, for example
+// release.zip!/lib/foo.so. With a depth of one, members of archives are found
+// but archives in archives are not read. The default is zero, so archives are
+// not read.
+func WithArchiveDepth(archiveDepth int) Option {
+	return func(f *DupFinder) {
+		f.archiveDepth = archiveDepth
+	}
+}
+
+// newArchiveReader returns a new archiveReader for the archive of the given
+// format with contents r. size is the size of the archive.
+func newArchiveReader(format archiveFormat, r io.Reader, size int64) (archiveReader, error) {
+	switch format {
+	case archiveFormatZip:
+		readerAt, ok := r.(io.ReaderAt)
+		if !ok {
+			// Zip archives in other archives can only be read in their
+			// entirety.
+			data, err := io.ReadAll(r)
+			if err != nil {
+				return nil, err
+			}
+			readerAt = bytes.NewReader(data)
+			size = int64(len(data))
+		}
+		zipReader, err := zip.NewReader(readerAt, size)
+		if err != nil {
+			return nil, err
+		}
+		return &zipArchiveReader{
+			files: zipReader.File,
+		}, nil
+	case archiveFormatTar:
+		return &tarArchiveReader{
+			tarReader: tar.NewReader(r),
+		}, nil
+	case archiveFormatTarGzip:
+		gzipReader, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return &tarArchiveReader{
+			tarReader: tar.NewReader(gzipReader),
+		}, nil
+	default:
+		return nil, fmt.Errorf("%d: unknown archive format", format)
+	}
+}
+
+// open opens the contents of m.
+func (m *archiveMember) open() (io.ReadCloser, error) {
+	file, err := os.Open(m.file)
+	if err != nil {
+		return nil, err
+	}
+	fileInfo, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	var r io.Reader = file
+	toClose := closers{file}
+	size := fileInfo.Size()
+	container := m.file
+	for _, name := range m.names {
+		entry, err := findArchiveEntry(container, r, size, name)
+		if err != nil {
+			toClose.Close()
+			return nil, err
+		}
+		entryReader, err := entry.open()
+		if err != nil {
+			toClose.Close()
+			return nil, err
+		}
+		r = entryReader
+		toClose = append(toClose, entryReader)
+		size = entry.fileInfo.Size()
+		container = name
+	}
+	return readCloser{
+		Reader: r,
+		Closer: toClose,
+	}, nil
+}
+
+// Close implements io.Closer.Close.
+func (c closers) Close() error {
+	errs := make([]error, 0, len(c))
+	for i := len(c) - 1; i >= 0; i-- {
+		errs = append(errs, c[i].Close())
+	}
+	return errors.Join(errs...)
+}
+
+// next implements archiveReader.next.
+func (r *tarArchiveReader) next() (*archiveEntry, error) {
+	for {
+		header, err := r.tarReader.Next()
+		if err != nil {
+			return nil, err
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+		return &archiveEntry{
+			name:     header.Name,
+			fileInfo: header.FileInfo(),
+			open: func() (io.ReadCloser, error) {
+				return io.NopCloser(r.tarReader), nil
+			},
+		}, nil
+	}
+}
+
+// next implements archiveReader.next.
+func (r *zipArchiveReader) next() (*archiveEntry, error) {
+	for len(r.files) > 0 {
+		file := r.files[0]
+		r.files = r.files[1:]
+		if !file.Mode().IsRegular() {
+			continue
+		}
+		return &archiveEntry{
+			name:     file.Name,
+			fileInfo: file.FileInfo(),
+			open: func() (io.ReadCloser, error) {
+				return file.Open()
+			},
+		}, nil
+	}
+	return nil, io.EOF
+}
+
+// scanArchiveFile sends the members of the archive p, found in root, to
+// regularFilesCh, if p is an archive. Members of archives in the archive are
+// also sent, up to the maximum archive depth. Each member is hashed as it is
+// read, as archives can only be read cheaply from the start. Errors reading
+// archives are passed to handleError and do not stop the walk. It returns
+// ctx.Err() if ctx is done.
+func (f *DupFinder) scanArchiveFile(ctx context.Context, root string, p pathWithSize, regularFilesCh chan<- pathWithSize, handleError func(path string, err error)) error {
+	if _, ok := archiveFormatOf(p.path); !ok {
+		return nil
+	}
+	file, err := os.Open(p.path)
+	if err != nil {
+		handleError(p.path, err)
+		return nil
+	}
+	defer file.Close()
+	// includeFunc returns whether member is included and within the limits.
+	includeFunc := func(member pathWithSize, fileInfo fs.FileInfo) bool {
+		return f.includes(root, member.path, false) && f.withinLimits(fileInfo)
+	}
+	// foundFunc sends member, which has been hashed, to regularFilesCh.
+	foundFunc := func(member pathWithSize) {
+		member.root = root
+		member.reference = p.reference
+		member.inode = inode{dev: p.inode.dev}
+		f.statistics.files.Add(1)
+		f.statistics.totalBytes.Add(uint64(member.size)) //nolint:gosec
+		sendToQueue(ctx, f.pipelineStatistics(pipelineStageWalk), regularFilesCh, member)
+	}
+	member := &archiveMember{
+		file: p.path,
+	}
+	if err := f.scanArchive(ctx, p.path, member, file, p.size, f.archiveDepth, includeFunc, foundFunc, handleError); err != nil && ctx.Err() == nil {
+		handleError(p.path, err)
+	}
+	return ctx.Err()
+}
+
+// scanArchive calls foundFunc with each member of the archive at archivePath,
+// which has contents r and size bytes, and with the members of the archives
+// in it up to depth levels deep. member identifies the archive. Only members
+// for which includeFunc returns true are read, and they are hashed before
+// foundFunc is called. Errors reading members are passed to handleError.
+// Scanning stops when ctx is done.
+func (f *DupFinder) scanArchive(ctx context.Context, archivePath string, member *archiveMember, r io.Reader, size int64, depth int, includeFunc func(pathWithSize, fs.FileInfo) bool, foundFunc func(pathWithSize), handleError func(path string, err error)) error {
+	format, _ := archiveFormatOf(archivePath)
+	archiveReader, err := newArchiveReader(format, r, size)
+	if err != nil {
+		return err
+	}
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		entry, err := archiveReader.next()
+		switch {
+		case errors.Is(err, io.EOF):
+			return nil
+		case err != nil:
+			return err
+		}
+		p := pathWithSize{
+			path:      archivePath + archiveSeparator + strings.TrimPrefix(path.Clean("/"+entry.name), "/"),
+			size:      entry.fileInfo.Size(),
+			mode:      entry.fileInfo.Mode(),
+			modTime:   entry.fileInfo.ModTime().UnixNano(),
+			container: archivePath,
+			member: &archiveMember{
+				file:  member.file,
+				names: append(slices.Clip(member.names), entry.name),
+			},
+		}
+		if !includeFunc(p, entry.fileInfo) {
+			continue
+		}
+		entryReader, err := entry.open()
+		if err != nil {
+			handleError(p.path, err)
+			continue
+		}
+		memberHasher := f.newMemberHasher(p.size)
+		contents := io.TeeReader(entryReader, memberHasher)
+		if _, ok := archiveFormatOf(entry.name); ok && depth > 1 {
+			if err := f.scanArchive(ctx, p.path, p.member, contents, p.size, depth-1, includeFunc, foundFunc, handleError); err != nil && ctx.Err() == nil {
+				handleError(p.path, err)
+			}
+		}
+		err = discard(ctx, contents)
+		entryReader.Close()
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			handleError(p.path, err)
+			continue
+		}
+		hashes, err := memberHasher.sums()
+		if err != nil {
+			handleError(p.path, err)
+			continue
+		}
+		f.statistics.bytesHashed.Add(uint64(p.size)) //nolint:gosec
+		p.member.hashes = hashes
+		foundFunc(p)
+	}
+}
+
+// newMemberHasher returns a new memberHasher for an archive member of size
+// bytes.
+func (f *DupFinder) newMemberHasher(size int64) *memberHasher {
+	h := &memberHasher{
+		blockSize: f.blockSize,
+		size:      size,
+	}
+	for stage := range h.hashes {
+		h.hashes[stage] = f.newHashFunc()
+	}
+	return h
+}
+
+// Write implements io.Writer.Write.
+func (h *memberHasher) Write(data []byte) (int, error) {
+	start, end := h.written, h.written+int64(len(data))
+	if start < h.blockSize {
+		h.hashes[hashStageHead].Write(data[:min(end, h.blockSize)-start])
+	}
+	if tailStart := h.size - h.blockSize; end > tailStart {
+		h.hashes[hashStageTail].Write(data[max(tailStart-start, 0):])
+	}
+	h.hashes[hashStageFull].Write(data)
+	h.written = end
+	return len(data), nil
+}
+
+// sums returns the hash of each hash stage. It returns io.ErrUnexpectedEOF if
+// fewer than h.size bytes were written.
+func (h *memberHasher) sums() ([numHashStages]string, error) {
+	var sums [numHashStages]string
+	if h.written != h.size {
+		return sums, io.ErrUnexpectedEOF
+	}
+	for stage, stageHash := range h.hashes {
+		sums[stage] = string(stageHash.Sum(nil))
+	}
+	return sums, nil
+}
+
+// archiveFormatOf returns the format of the archive called name, and false if
+// name is not an archive.
+func archiveFormatOf(name string) (archiveFormat, bool) {
+	lowerName := strings.ToLower(name)
+	for _, archiveFormatSuffix := range archiveFormatSuffixes {
+		if strings.HasSuffix(lowerName, archiveFormatSuffix.suffix) {
+			return archiveFormatSuffix.format, true
+		}
+	}
+	return 0, false
+}
+
+// discard reads r until EOF. r is read in chunks so that reading large
+// contents stops soon after ctx is done.
+func discard(ctx context.Context, r io.Reader) error {
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		_, err := io.CopyN(io.Discard, r, hashChunkSize)
+		switch {
+		case errors.Is(err, io.EOF):
+			return nil
+		case err != nil:
+			return err
+		}
+	}
+}
+
+// findArchiveEntry returns the entry called name in the archive called
+// container with contents r, which has size bytes.
+func findArchiveEntry(container string, r io.Reader, size int64, name string) (*archiveEntry, error) {
+	format, _ := archiveFormatOf(container)
+	archiveReader, err := newArchiveReader(format, r, size)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		entry, err := archiveReader.next()
+		switch {
+		case errors.Is(err, io.EOF):
+			return nil, fs.ErrNotExist
+		case err != nil:
+			return nil, err
+		case entry.name == name:
+			return entry, nil
+		}
+	}
+}
+
+// openFile opens the file at path or, if member is not nil, the archive member
+// at path.
+func openFile(path string, member *archiveMember) (io.ReadCloser, error) {
+	if member == nil {
+		return os.Open(path)
+	}
+	return member.open()
+}
@@ -0,0 +1,32 @@
+package dupfind
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// isRotational returns whether the block device dev is a rotational disk, as
+// reported by /sys/block/<disk>/queue/rotational. Devices that are not block
+// devices, for example NFS and tmpfs, are not rotational.
+func isRotational(dev uint64) bool {
+	major, minor := unix.Major(dev), unix.Minor(dev)
+	if major == 0 {
+		return false
+	}
+	path, err := filepath.EvalSymlinks("/sys/dev/block/" + strconv.FormatUint(uint64(major), 10) + ":" + strconv.FormatUint(uint64(minor), 10))
+	if err != nil {
+		return false
+	}
+	// Partitions do not have a queue, so use their disk's.
+	for range 2 {
+		if data, err := os.ReadFile(filepath.Join(path, "queue", "rotational")); err == nil {
+			return strings.TrimSpace(string(data)) == "1"
+		}
+		path = filepath.Dir(path)
+	}
+	return false
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+
+package dupfind
+
+// isRotational returns whether the block device dev is a rotational disk. It
+// is only implemented on Linux.
+func isRotational(uint64) bool {
+	return false
+}
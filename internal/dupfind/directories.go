@@ -0,0 +1,296 @@
+package dupfind
+
+import (
+	"cmp"
+	"encoding/hex"
+	"io/fs"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// A tree records the entries of every directory walked, so that the contents
+// of directories can be compared once the contents of files are known. It is
+// safe for concurrent use.
+type tree struct {
+	mutex       sync.Mutex
+	directories map[string]*treeDirectory
+}
+
+// A treeDirectory is a directory in a tree. walked is true once the directory
+// itself has been walked. incomplete is true if any of its entries could not
+// be recorded, in which case it cannot be compared.
+type treeDirectory struct {
+	pathWithSize
+	walked     bool
+	incomplete bool
+	entries    map[string]treeEntry
+}
+
+// A treeEntry is an entry in a treeDirectory. For regular files, it contains
+// the file's path and metadata. For symlinks, it contains the symlink's
+// target.
+type treeEntry struct {
+	pathWithSize
+	typ    fs.FileMode
+	target string
+}
+
+// A contentIndex identifies the contents of files that have duplicates.
+// keysByPath is indexed by clean path, like the paths in a tree.
+type contentIndex struct {
+	keysByPath  map[string]string
+	keysByInode map[inode]string
+}
+
+// A directoryHash is the hash of the contents of a directory. size and files
+// are the total size and number of regular files in the directory and its
+// subdirectories. ok is false if the directory cannot be compared, for example
+// because it contains a file that is not a duplicate of any other file.
+type directoryHash struct {
+	hash  string
+	size  int64
+	files int
+	ok    bool
+}
+
+// WithDirectories sets whether to find duplicate directories instead of
+// duplicate files. Directories are duplicates if they contain entries with the
+// same names and, recursively, the same contents. Only the top-most duplicate
+// directories are reported: groups of directories with the same name whose
+// parents are all in the same group are not reported. Directories that do not
+// contain any regular files are not reported.
+func WithDirectories(directories bool) Option {
+	return func(f *DupFinder) {
+		f.directories = directories
+	}
+}
+
+// findDuplicateDirectories returns the groups of duplicate directories in
+// f.tree, given fileResult, the groups of duplicate files with a threshold of
+// two.
+func (f *DupFinder) findDuplicateDirectories(fileResult *Result) *Result {
+	contentIndex := newContentIndex(fileResult)
+
+	// Hash every directory, recursively.
+	directoryHashes := make(map[string]directoryHash, len(f.tree.directories))
+	var hashDirectory func(string) directoryHash
+	hashDirectory = func(path string) directoryHash {
+		if directoryHash, ok := directoryHashes[path]; ok {
+			return directoryHash
+		}
+		var result directoryHash
+		defer func() {
+			directoryHashes[path] = result
+		}()
+		directory := f.tree.directories[path]
+		if directory == nil || !directory.walked || directory.incomplete {
+			return result
+		}
+		hash := f.newHashFunc()
+		for _, name := range slices.Sorted(maps.Keys(directory.entries)) {
+			entry := directory.entries[name]
+			var identifier string
+			switch {
+			case entry.typ == 0:
+				key, ok := contentIndex.key(entry.pathWithSize)
+				if !ok {
+					return result
+				}
+				identifier = "f" + key
+				result.size += entry.size
+				result.files++
+			case entry.typ.IsDir():
+				subdirectoryHash := hashDirectory(entry.path)
+				if !subdirectoryHash.ok {
+					return result
+				}
+				identifier = "d" + subdirectoryHash.hash
+				result.size += subdirectoryHash.size
+				result.files += subdirectoryHash.files
+			case entry.typ&fs.ModeSymlink != 0:
+				identifier = "l" + entry.target
+			default:
+				return result
+			}
+			hash.Write([]byte(name + "\x00" + identifier + "\x00"))
+		}
+		result.hash = string(hash.Sum(nil))
+		result.ok = true
+		return result
+	}
+	directoriesByHash := make(map[string][]string)
+	for _, path := range slices.Sorted(maps.Keys(f.tree.directories)) {
+		directoryHash := hashDirectory(path)
+		if directoryHash.ok && directoryHash.files > 0 {
+			directoriesByHash[directoryHash.hash] = append(directoriesByHash[directoryHash.hash], path)
+		}
+	}
+
+	// Find the group of each duplicate directory.
+	groupHashes := make(map[string]string)
+	for hash, paths := range directoriesByHash {
+		if len(paths) >= f.threshold {
+			for _, path := range paths {
+				groupHashes[path] = hash
+			}
+		}
+	}
+
+	// Report the top-most duplicate directories.
+	result := &Result{}
+	for _, hash := range slices.Sorted(maps.Keys(directoriesByHash)) {
+		paths := directoriesByHash[hash]
+		if len(paths) < f.threshold {
+			continue
+		}
+		// A group is implied by the group of its parents if every directory
+		// has the same name and its parent is in the same group.
+		name := filepath.Base(paths[0])
+		parentHash, ok := groupHashes[filepath.Dir(paths[0])]
+		if ok && !slices.ContainsFunc(paths, func(path string) bool {
+			return filepath.Base(path) != name || groupHashes[filepath.Dir(path)] != parentHash
+		}) {
+			continue
+		}
+		files := make([]File, 0, len(paths))
+		for _, path := range paths {
+			files = append(files, f.tree.directories[path].file())
+		}
+		if !f.includesReferences(files) {
+			continue
+		}
+		size := directoryHashes[paths[0]].size
+		hexHash := hex.EncodeToString([]byte(hash))
+		result.Groups = append(result.Groups, &Group{
+			Key:         hexHash,
+			Hash:        hexHash,
+			Size:        size,
+			WastedBytes: int64(len(files)-1) * size,
+			Files:       files,
+		})
+	}
+	slices.SortFunc(result.Groups, func(a, b *Group) int {
+		return cmp.Or(
+			strings.Compare(a.Hash, b.Hash),
+			strings.Compare(a.Files[0].Path, b.Files[0].Path),
+		)
+	})
+	for _, group := range result.Groups {
+		result.WastedBytes += group.WastedBytes
+	}
+	return result
+}
+
+// newContentIndex returns a new contentIndex that identifies the contents of
+// the files in result.
+func newContentIndex(result *Result) *contentIndex {
+	c := &contentIndex{
+		keysByPath:  make(map[string]string),
+		keysByInode: make(map[inode]string),
+	}
+	for _, group := range result.Groups {
+		key := group.Key + "/" + strconv.FormatInt(group.Size, 10)
+		for _, file := range group.Files {
+			c.keysByPath[filepath.Clean(file.Path)] = key
+			if file.Ino != 0 {
+				c.keysByInode[inode{dev: file.Dev, ino: file.Ino}] = key
+			}
+		}
+	}
+	return c
+}
+
+// newTree returns a new, empty tree.
+func newTree() *tree {
+	return &tree{
+		directories: make(map[string]*treeDirectory),
+	}
+}
+
+// add records the entry at path with dirEntry, which was found in root. If the
+// entry is a regular file then p contains its metadata, otherwise only
+// p.reference is used.
+func (t *tree) add(root, path string, dirEntry fs.DirEntry, p pathWithSize) error {
+	path = filepath.Clean(path)
+	entry := treeEntry{
+		pathWithSize: p,
+		typ:          dirEntry.Type(),
+	}
+	switch {
+	case entry.typ.IsDir():
+		fileInfo, err := dirEntry.Info()
+		if err != nil {
+			return err
+		}
+		entry.pathWithSize = pathWithSize{
+			path:      path,
+			root:      root,
+			reference: p.reference,
+			mode:      fileInfo.Mode(),
+			modTime:   fileInfo.ModTime().UnixNano(),
+		}
+		entry.inode, _, _ = inodeAndNlink(fileInfo)
+	case entry.typ&fs.ModeSymlink != 0:
+		target, err := os.Readlink(path)
+		if err != nil {
+			return err
+		}
+		entry.path = path
+		entry.target = target
+	default:
+		entry.path = path
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if entry.typ.IsDir() {
+		directory := t.directory(path)
+		directory.pathWithSize = entry.pathWithSize
+		directory.walked = true
+	}
+	if path != filepath.Clean(root) {
+		t.directory(filepath.Dir(path)).entries[filepath.Base(path)] = entry
+	}
+	return nil
+}
+
+// key returns a key that identifies the contents of p, if p has any
+// duplicates. Hard links, and files reached through overlapping roots, that
+// are not reported in any group are found by their inode.
+func (c *contentIndex) key(p pathWithSize) (string, bool) {
+	if key, ok := c.keysByPath[p.path]; ok {
+		return key, true
+	}
+	if p.inode.ino != 0 {
+		key, ok := c.keysByInode[p.inode]
+		return key, ok
+	}
+	return "", false
+}
+
+// directory returns the treeDirectory at path, creating it if needed. t.mutex
+// must be held.
+func (t *tree) directory(path string) *treeDirectory {
+	directory, ok := t.directories[path]
+	if !ok {
+		directory = &treeDirectory{
+			entries: make(map[string]treeEntry),
+		}
+		t.directories[path] = directory
+	}
+	return directory
+}
+
+// markIncomplete marks the directory at path and its parent as incomplete.
+func (t *tree) markIncomplete(path string) {
+	path = filepath.Clean(path)
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.directory(path).incomplete = true
+	t.directory(filepath.Dir(path)).incomplete = true
+}
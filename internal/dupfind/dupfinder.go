@@ -1,32 +1,82 @@
 package dupfind
 
-// FIXME when keeping going despite errors this code can panic with "write to closed channel" as DupFinder.FindDuplicates closes channels while goroutines are still running
-
 import (
+	"cmp"
 	"context"
 	"encoding/hex"
+	"errors"
 	"hash"
 	"io"
 	"io/fs"
+	"maps"
+	"math"
 	"os"
+	"path/filepath"
+	"runtime"
 	"slices"
+	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/charlievieth/fastwalk"
-	"github.com/twpayne/go-heap"
 	"golang.org/x/sys/cpu"
+
+	"github.com/twpayne/find-duplicates/internal/filter"
 )
 
 // A DupFinder finds duplicate files.
 type DupFinder struct {
+	archiveDepth          int
+	blockSize             int64
 	channelBufferCapacity int
+	deviceConcurrency     func(dev uint64, rotational bool) int
+	deviceSemaphores      map[uint64]chan struct{}
+	deviceMutex           sync.Mutex
+	directories           bool
 	newHashFunc           func() hash.Hash
 	emptyHash             string
-	includeFunc           func(string) bool
+	filter                *filter.Filter
+	openFiles             chan struct{}
 	errorHandler          func(error) error
+	errors                []*PathError
+	groupFunc             func(*Group) error
+	hashCache             HashCache
+	ignoreFiles           []string
+	hashConcurrency       int
+	hashCacheAlgorithm    string
+	hardlinkMode          HardlinkMode
+	progressFunc          func(*Progress)
+	progressInterval      time.Duration
+	queuesMutex           sync.Mutex
+	queues                []queue
+	hardlinks             map[inode][]pathWithSize
+	hardlinkHashesMutex   sync.Mutex
+	hardlinkHashes        map[HashCacheKey]*memoizedHash
+	findMode              findMode
+	followSymlinks        bool
+	oneFileSystem         bool
+	referenceRoots        []string
+	absReferenceRoots     []string
+	referenceCopies       map[inode]pathWithSize
+	reportSymlinks        bool
+	resolvedRoots         []string
+	symlinksMutex         sync.Mutex
+	symlinks              map[inode][]string
 	roots                 []string
 	threshold             int
+	tree                  *tree
+	uniqueMutex           sync.Mutex
+	unique                []pathWithSize
+	verify                bool
+	minSize               int64
+	maxSize               int64
+	modifiedSince         time.Time
+	modifiedBefore        time.Time
+	visitedMutex          sync.Mutex
+	visited               map[inode]struct{}
+	workingDir            string
 	statistics            struct {
 		errors      atomic.Uint64
 		_           cpu.CacheLinePad
@@ -42,35 +92,231 @@ type DupFinder struct {
 		_           cpu.CacheLinePad
 		uniqueSizes atomic.Uint64
 		_           cpu.CacheLinePad
+		collisions  atomic.Uint64
+		_           cpu.CacheLinePad
+		cacheHits   atomic.Uint64
+		_           cpu.CacheLinePad
+		cacheMisses atomic.Uint64
+		_           cpu.CacheLinePad
+		hardlinks   atomic.Uint64
+		_           cpu.CacheLinePad
+		candidates  atomic.Uint64
+		_           cpu.CacheLinePad
+		bytesQueued atomic.Uint64
+		_           cpu.CacheLinePad
+		bytesDone   atomic.Uint64
+		_           cpu.CacheLinePad
+		stages      [numHashStages]struct {
+			stageStatistics
+			_ cpu.CacheLinePad
+		}
+		pipeline [numPipelineStages]struct {
+			pipelineStageStatistics
+			_ cpu.CacheLinePad
+		}
 	}
 }
 
+// hashChunkSize is the number of bytes hashed between checks for
+// cancellation.
+const hashChunkSize = 1 << 20
+
+// A hashStage is a stage in which file contents are hashed. Each stage only
+// receives the paths that still collide after the previous stage.
+type hashStage int
+
+// Hash stages.
+const (
+	hashStageHead hashStage = iota
+	hashStageTail
+	hashStageFull
+	numHashStages
+)
+
+// A findMode determines what is found by [DupFinder.findFiles].
+type findMode int
+
+// Find modes.
+const (
+	// findModeDuplicates finds the groups of duplicates that are reported.
+	findModeDuplicates findMode = iota
+	// findModeDirectories finds all files with at least one duplicate and
+	// records every directory walked, so that directories can be compared.
+	findModeDirectories
+	// findModeUnique finds all files with at least one duplicate and records
+	// every file without one.
+	findModeUnique
+)
+
+// stageStatistics contains the statistics for a single hashStage.
+type stageStatistics struct {
+	filesHashed     atomic.Uint64
+	bytesHashed     atomic.Uint64
+	filesEliminated atomic.Uint64
+	bytesSaved      atomic.Uint64
+	hashLatency     latencyHistogram
+}
+
+// A File is a file in a [Group]. Reference is true if the file is in a
+// reference root, see [WithReferenceRoots]. Container is the path of the
+// archive that contains the file if the file is an archive member, see
+// [WithArchiveDepth].
+type File struct {
+	Path      string      `json:"path"`
+	Root      string      `json:"root"`
+	Reference bool        `json:"reference,omitempty"`
+	Size      int64       `json:"size"`
+	Mode      fs.FileMode `json:"mode"`
+	ModTime   time.Time   `json:"modTime"`
+	Dev       uint64      `json:"dev"`
+	Ino       uint64      `json:"ino"`
+	Container string      `json:"container,omitempty"`
+	member    *archiveMember
+}
+
+// A Group is a group of duplicate files. Key is the group's unique key in
+// [Result.Map], which is its hash, followed by a numeric suffix if an earlier
+// group has the same hash. WastedBytes is the number of bytes that would be
+// reclaimed by keeping only one of the files. Symlinks are the symlinks that
+// resolve to one of the files, if enabled with [WithReportSymlinks].
+type Group struct {
+	Key         string   `json:"key"`
+	Hash        string   `json:"hash"`
+	Size        int64    `json:"size"`
+	WastedBytes int64    `json:"wastedBytes"`
+	Files       []File   `json:"files"`
+	Symlinks    []string `json:"symlinks,omitempty"`
+}
+
+// A HardlinkMode determines how paths that are hard links to the same file are
+// reported. In all modes, each file is only hashed once.
+type HardlinkMode int
+
+// Hardlink modes.
+const (
+	// HardlinkModeDuplicates reports hard links as duplicates of each other.
+	HardlinkModeDuplicates HardlinkMode = iota
+	// HardlinkModeGroup reports only one path for each file in duplicates
+	// and reports hard links separately, see [DupFinder.Hardlinks].
+	HardlinkModeGroup
+	// HardlinkModeHide reports only one path for each file.
+	HardlinkModeHide
+)
+
+// A HashCacheKey identifies a range of bytes in a particular version of a
+// file.
+type HashCacheKey struct {
+	Dev       uint64
+	Ino       uint64
+	Size      int64
+	ModTimeNs int64
+	Algorithm string
+	Offset    int64
+	Length    int64
+}
+
+// A HashCache caches the hashes of ranges of bytes in files. Implementations
+// must be safe for concurrent use.
+type HashCache interface {
+	Get(key HashCacheKey) (string, bool)
+	Set(key HashCacheKey, hash string)
+}
+
 // An Option sets an option on a [*DupFinder].
 type Option func(*DupFinder)
 
+// A Result contains all the groups of duplicate files found and the total
+// number of wasted bytes.
+type Result struct {
+	Groups      []*Group `json:"groups"`
+	WastedBytes int64    `json:"wastedBytes"`
+}
+
 // Statistics contains various statistics.
 type Statistics struct {
-	Errors             uint64  `json:"errors"`
-	DirEntries         uint64  `json:"dirEntries"`
-	Files              uint64  `json:"files"`
-	FilesOpened        uint64  `json:"filesOpened"`
-	FilesOpenedPercent float64 `json:"filesOpenedPercent"`
-	TotalBytes         uint64  `json:"totalBytes"`
-	BytesHashed        uint64  `json:"bytesHashed"`
-	BytesHashedPercent float64 `json:"bytesHashedPercent"`
-	UniqueSizes        uint64  `json:"uniqueSizes"`
-}
-
-// A pathWithSize contains a path to a regular file and its size.
+	Errors             uint64          `json:"errors"`
+	DirEntries         uint64          `json:"dirEntries"`
+	Files              uint64          `json:"files"`
+	FilesOpened        uint64          `json:"filesOpened"`
+	FilesOpenedPercent float64         `json:"filesOpenedPercent"`
+	TotalBytes         uint64          `json:"totalBytes"`
+	BytesHashed        uint64          `json:"bytesHashed"`
+	BytesHashedPercent float64         `json:"bytesHashedPercent"`
+	UniqueSizes        uint64          `json:"uniqueSizes"`
+	Collisions         uint64          `json:"collisions"`
+	CacheHits          uint64          `json:"cacheHits"`
+	CacheMisses        uint64          `json:"cacheMisses"`
+	Hardlinks          uint64          `json:"hardlinks"`
+	Head               StageStatistics `json:"head"`
+	Tail               StageStatistics `json:"tail"`
+	Full               StageStatistics `json:"full"`
+	// BytesHashedPerSecond is the hashing throughput from when the first
+	// file was hashed to when the last file was hashed.
+	BytesHashedPerSecond float64                   `json:"bytesHashedPerSecond"`
+	Pipeline             []PipelineStageStatistics `json:"pipeline"`
+}
+
+// StageStatistics contains statistics for a single hashing stage.
+// FilesEliminated is the number of files whose hash at this stage did not
+// collide with any other file, and BytesSaved is the number of bytes of those
+// files that did not need to be read.
+type StageStatistics struct {
+	FilesHashed     uint64 `json:"filesHashed"`
+	BytesHashed     uint64 `json:"bytesHashed"`
+	FilesEliminated uint64 `json:"filesEliminated"`
+	BytesSaved      uint64 `json:"bytesSaved"`
+}
+
+// An inode identifies a file on a device.
+type inode struct {
+	dev uint64
+	ino uint64
+}
+
+// A pathWithSize contains a path to a regular file, the root in which it was
+// found, whether it is in a reference root, its size, and its metadata. inode
+// and nlink are zero if they are not known. If the file is an archive member
+// then container is the path of the archive that contains it and member
+// identifies it.
 type pathWithSize struct {
-	path string
-	size int64
+	path      string
+	root      string
+	reference bool
+	size      int64
+	mode      fs.FileMode
+	inode     inode
+	nlink     uint64
+	modTime   int64
+	container string
+	member    *archiveMember
 }
 
-// A pathWithHash contains a path to a regular file and its hash.
+// A pathWithHash contains a path to a regular file, its size, and its hash. If
+// complete is true then hash is the hash of the file's entire contents,
+// otherwise it is the concatenation of the partial hashes computed so far. If
+// done is true then it does not contain a path but instead indicates that all
+// count paths with size have been sent, see [sizeClass].
 type pathWithHash struct {
-	path string
+	pathWithSize
+	hash     string
+	complete bool
+	done     bool
+	count    int
+}
+
+// A memoizedHash is a hash that is computed at most once.
+type memoizedHash struct {
+	once sync.Once
 	hash string
+	err  error
+}
+
+// WithBlockSize sets the size of the blocks at the start and end of each file
+// that are hashed before the file's entire contents are hashed.
+func WithBlockSize(blockSize int64) Option {
+	return func(f *DupFinder) {
+		f.blockSize = blockSize
+	}
 }
 
 // WithChannelBufferCapacity sets the buffer capacity between different
@@ -82,12 +328,60 @@ func WithChannelBufferCapacity(channelBufferCapacity int) Option {
 	}
 }
 
+// WithDeviceConcurrency sets the function that returns the maximum number of
+// files on the device dev that are hashed concurrently. rotational is whether
+// dev is a rotational disk, for which reading files concurrently is slow. The
+// concurrency of each device is at most the hash concurrency, see
+// [WithHashConcurrency]. The default is one for rotational disks and the hash
+// concurrency for other devices.
+func WithDeviceConcurrency(deviceConcurrency func(dev uint64, rotational bool) int) Option {
+	return func(f *DupFinder) {
+		f.deviceConcurrency = deviceConcurrency
+	}
+}
+
+// WithErrorHandler sets a function that is called with each error, for example
+// when a file cannot be read. If errorHandler returns nil then the file is
+// skipped and the search continues, otherwise the search is cancelled and the
+// returned error is returned. The default error handler returns the error.
 func WithErrorHandler(errorHandler func(error) error) Option {
 	return func(f *DupFinder) {
 		f.errorHandler = errorHandler
 	}
 }
 
+// WithFilter sets the filter that determines which files and directories are
+// walked. Excluded directories are not walked. If not set, all paths are
+// included.
+func WithFilter(filter *filter.Filter) Option {
+	return func(f *DupFinder) {
+		f.filter = filter
+	}
+}
+
+// WithFollowSymlinks sets whether symlinks are followed. Symlinks to
+// directories are walked and symlinks to regular files are treated as regular
+// files. Symlinks to directories in a root are not followed, as they are
+// walked anyway, and each other directory is walked at most once, even if it
+// is reached through several symlinks, which prevents loops. A file that is
+// reached through several paths is treated like a file with several hard
+// links, see [WithHardlinkMode].
+func WithFollowSymlinks(followSymlinks bool) Option {
+	return func(f *DupFinder) {
+		f.followSymlinks = followSymlinks
+	}
+}
+
+// WithGroupFunc sets a function that is called with each group of duplicates
+// as soon as it is final, i.e. once no more files can be added to it. This
+// allows groups to be processed before all files have been hashed. Errors
+// returned by groupFunc are passed to the error handler.
+func WithGroupFunc(groupFunc func(*Group) error) Option {
+	return func(f *DupFinder) {
+		f.groupFunc = groupFunc
+	}
+}
+
 // WithHashFunc sets the hash.
 func WithHashFunc(hashFunc func() hash.Hash) Option {
 	return func(f *DupFinder) {
@@ -96,11 +390,101 @@ func WithHashFunc(hashFunc func() hash.Hash) Option {
 	}
 }
 
-// WithIncludeFunc sets the function that determines whether paths are included.
-// If not set, all paths are included.
-func WithIncludeFunc(includeFunc func(string) bool) Option {
+// WithHardlinkMode sets how paths that are hard links to the same file are
+// reported.
+func WithHardlinkMode(hardlinkMode HardlinkMode) Option {
+	return func(f *DupFinder) {
+		f.hardlinkMode = hardlinkMode
+	}
+}
+
+// WithHashConcurrency sets the maximum number of files that are open for
+// hashing concurrently, across all devices. The default is four times
+// GOMAXPROCS.
+func WithHashConcurrency(hashConcurrency int) Option {
+	return func(f *DupFinder) {
+		f.hashConcurrency = hashConcurrency
+	}
+}
+
+// WithHashCache sets the cache of hashes. algorithm identifies the hash set
+// with [WithHashFunc] so that hashes computed with different algorithms are
+// not confused.
+func WithHashCache(hashCache HashCache, algorithm string) Option {
+	return func(f *DupFinder) {
+		f.hashCache = hashCache
+		f.hashCacheAlgorithm = algorithm
+	}
+}
+
+// WithMaxSize sets the maximum size of files. Larger files are skipped. The
+// default is no maximum.
+func WithMaxSize(maxSize int64) Option {
+	return func(f *DupFinder) {
+		f.maxSize = maxSize
+	}
+}
+
+// WithMinSize sets the minimum size of files. Smaller files are skipped. The
+// default is zero.
+func WithMinSize(minSize int64) Option {
 	return func(f *DupFinder) {
-		f.includeFunc = includeFunc
+		f.minSize = minSize
+	}
+}
+
+// WithModifiedBefore skips files that were last modified at or after
+// modifiedBefore. The default, the zero time, skips no files.
+func WithModifiedBefore(modifiedBefore time.Time) Option {
+	return func(f *DupFinder) {
+		f.modifiedBefore = modifiedBefore
+	}
+}
+
+// WithModifiedSince skips files that were last modified before modifiedSince.
+// The default, the zero time, skips no files.
+func WithModifiedSince(modifiedSince time.Time) Option {
+	return func(f *DupFinder) {
+		f.modifiedSince = modifiedSince
+	}
+}
+
+// WithOneFileSystem sets whether the walk of each root stays on the root's
+// file system. Directories and symlink targets on other devices are skipped.
+// It has no effect on platforms where devices are not known.
+func WithOneFileSystem(oneFileSystem bool) Option {
+	return func(f *DupFinder) {
+		f.oneFileSystem = oneFileSystem
+	}
+}
+
+// WithReferenceRoots sets the reference roots. Reference roots are walked like
+// other roots, but groups of duplicates are only reported if they contain at
+// least one file in a reference root and at least one file that is not, so
+// duplicates within reference roots are ignored. Whether a file is in a
+// reference root depends only on its absolute path, so a file is in a reference
+// root however the roots are spelled.
+func WithReferenceRoots(referenceRoots ...string) Option {
+	return func(f *DupFinder) {
+		f.referenceRoots = append(f.referenceRoots, referenceRoots...)
+		for _, referenceRoot := range referenceRoots {
+			absReferenceRoot, err := filepath.Abs(referenceRoot)
+			if err != nil {
+				absReferenceRoot = filepath.Clean(referenceRoot)
+			}
+			f.absReferenceRoots = append(f.absReferenceRoots, absReferenceRoot)
+		}
+	}
+}
+
+// WithReportSymlinks sets whether the symlinks that resolve to files in each
+// group are reported, see [Group.Symlinks]. Symlinks are matched to files by
+// device and inode, so no symlinks are reported on platforms where they are
+// not known. Symlinks that are followed, see [WithFollowSymlinks], are
+// treated as files instead.
+func WithReportSymlinks(reportSymlinks bool) Option {
+	return func(f *DupFinder) {
+		f.reportSymlinks = reportSymlinks
 	}
 }
 
@@ -118,225 +502,1231 @@ func WithThreshold(threshold int) Option {
 	}
 }
 
+// WithVerify sets whether the contents of files with identical hashes are
+// compared byte by byte. Groups of files whose contents differ despite having
+// the same hash are split.
+func WithVerify(verify bool) Option {
+	return func(f *DupFinder) {
+		f.verify = verify
+	}
+}
+
 // NewDupFinder returns a new [*DupFinder] with the given options.
 func NewDupFinder(options ...Option) *DupFinder {
 	f := &DupFinder{
+		blockSize:             4096,
 		channelBufferCapacity: 1024,
 		errorHandler:          func(err error) error { return err },
+		hashConcurrency:       4 * runtime.GOMAXPROCS(0),
+		maxSize:               math.MaxInt64,
 		threshold:             2,
 	}
 	for _, option := range options {
 		option(f)
 	}
+	f.hashConcurrency = max(1, f.hashConcurrency)
+	if f.deviceConcurrency == nil {
+		f.deviceConcurrency = func(_ uint64, rotational bool) int {
+			if rotational {
+				return 1
+			}
+			return f.hashConcurrency
+		}
+	}
+	f.deviceSemaphores = make(map[uint64]chan struct{})
+	f.openFiles = make(chan struct{}, f.hashConcurrency)
 	return f
 }
 
+// Errors returns the errors for paths that were skipped by the last search
+// because the error handler returned nil, sorted by path. Groups that would
+// have included these paths may be incomplete.
+func (f *DupFinder) Errors() []*PathError {
+	return slices.SortedStableFunc(slices.Values(f.errors), func(a, b *PathError) int {
+		return strings.Compare(a.Path, b.Path)
+	})
+}
+
+// Find finds duplicate files or, if enabled with [WithDirectories], duplicate
+// directories.
+func (f *DupFinder) Find(ctx context.Context) (*Result, error) {
+	if !f.directories {
+		return f.findFiles(ctx, findModeDuplicates)
+	}
+	result, err := f.findFiles(ctx, findModeDirectories)
+	if err != nil {
+		return nil, err
+	}
+	result = f.findDuplicateDirectories(result)
+	if f.groupFunc != nil {
+		for _, group := range result.Groups {
+			if err := f.groupFunc(group); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return result, nil
+}
+
+// FindDuplicates finds duplicate files and returns their paths indexed by key,
+// see [Result.Map].
 func (f *DupFinder) FindDuplicates(ctx context.Context) (map[string][]string, error) {
+	result, err := f.Find(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return result.Map(), nil
+}
+
+// Hardlinks returns the groups of paths that are hard links to the same file
+// found by the last call to [DupFinder.FindDuplicates], if the hardlink mode is
+// [HardlinkModeGroup].
+func (f *DupFinder) Hardlinks() [][]string {
+	if f.hardlinkMode != HardlinkModeGroup {
+		return nil
+	}
+	var hardlinks [][]string
+	for _, pathsWithSize := range f.hardlinks {
+		if len(pathsWithSize) > 1 {
+			paths := make([]string, 0, len(pathsWithSize))
+			for _, p := range pathsWithSize {
+				paths = append(paths, p.path)
+			}
+			slices.Sort(paths)
+			hardlinks = append(hardlinks, paths)
+		}
+	}
+	slices.SortFunc(hardlinks, func(a, b []string) int {
+		return strings.Compare(a[0], b[0])
+	})
+	return hardlinks
+}
+
+func (f *DupFinder) Statistics() *Statistics {
+	errors := f.statistics.errors.Load()
+	dirEntries := f.statistics.dirEntries.Load()
+	files := f.statistics.files.Load()
+	filesOpened := f.statistics.filesOpened.Load()
+	totalBytes := f.statistics.totalBytes.Load()
+	bytesHashed := f.statistics.bytesHashed.Load()
+	uniqueSizes := f.statistics.uniqueSizes.Load()
+	hardlinks := f.statistics.hardlinks.Load()
+	collisions := f.statistics.collisions.Load()
+	cacheHits := f.statistics.cacheHits.Load()
+	cacheMisses := f.statistics.cacheMisses.Load()
+
+	pipeline := make([]PipelineStageStatistics, 0, numPipelineStages)
+	var hashStart, hashEnd time.Time
+	for stage := range numPipelineStages {
+		var stageBytesHashed uint64
+		if hashStage := slices.Index(hashPipelineStages[:], stage); hashStage != -1 {
+			stageBytesHashed = f.statistics.stages[hashStage].bytesHashed.Load()
+		}
+		pipelineStageStatistics := f.pipelineStatistics(stage).load(stage, stageBytesHashed)
+		if stageBytesHashed > 0 {
+			if hashStart.IsZero() || pipelineStageStatistics.Start.Before(hashStart) {
+				hashStart = pipelineStageStatistics.Start
+			}
+			if pipelineStageStatistics.End.After(hashEnd) {
+				hashEnd = pipelineStageStatistics.End
+			}
+		}
+		pipeline = append(pipeline, pipelineStageStatistics)
+	}
+
+	statistics := &Statistics{
+		Errors:             errors,
+		DirEntries:         dirEntries,
+		Files:              files,
+		FilesOpened:        filesOpened,
+		FilesOpenedPercent: 100 * float64(filesOpened) / max(1, float64(files)),
+		TotalBytes:         totalBytes,
+		BytesHashed:        bytesHashed,
+		BytesHashedPercent: 100 * float64(bytesHashed) / max(1, float64(totalBytes)),
+		UniqueSizes:        uniqueSizes,
+		Collisions:         collisions,
+		CacheHits:          cacheHits,
+		CacheMisses:        cacheMisses,
+		Hardlinks:          hardlinks,
+		Head:               f.statistics.stages[hashStageHead].load(),
+		Tail:               f.statistics.stages[hashStageTail].load(),
+		Full:               f.statistics.stages[hashStageFull].load(),
+		Pipeline:           pipeline,
+	}
+	if !hashStart.IsZero() {
+		if seconds := hashEnd.Sub(hashStart).Seconds(); seconds > 0 {
+			statistics.BytesHashedPerSecond = float64(bytesHashed) / seconds
+		}
+	}
+	return statistics
+}
+
+// absPath returns the clean absolute path of path, which is relative to the
+// working directory when the files were found.
+func (f *DupFinder) absPath(path string) string {
+	if filepath.IsAbs(path) {
+		return filepath.Clean(path)
+	}
+	return filepath.Join(f.workingDir, path)
+}
+
+// accumulateGroups reads paths from pathsWithHashCh and groups them by hash.
+// Groups are reported as soon as their size class is complete. It returns all
+// groups with at least threshold paths, sorted by hash and then by path.
+func (f *DupFinder) accumulateGroups(ctx context.Context, pathsWithHashCh <-chan pathWithHash, threshold int, errCh chan<- error) *Result {
+	result := &Result{}
+	keys := make(map[string]bool)
+	sizeClasses := make(sizeClasses)
+	for pathWithHash := range receive(f.pipelineStatistics(pipelineStageGroups), pathsWithHashCh) {
+		sizeClass := sizeClasses.get(pathWithHash.size)
+		if pathWithHash.done {
+			sizeClass.expected = pathWithHash.count
+		} else {
+			sizeClass.processed++
+			sizeClass.pathsByHash[pathWithHash.hash] = append(sizeClass.pathsByHash[pathWithHash.hash], pathWithHash)
+		}
+		if sizeClass.complete() {
+			f.reportGroups(ctx, result, keys, pathWithHash.size, sizeClass, threshold, errCh)
+			delete(sizeClasses, pathWithHash.size)
+		}
+	}
+	for _, size := range slices.Sorted(maps.Keys(sizeClasses)) {
+		f.reportGroups(ctx, result, keys, size, sizeClasses[size], threshold, errCh)
+	}
+	slices.SortFunc(result.Groups, func(a, b *Group) int {
+		return cmp.Or(
+			strings.Compare(a.Hash, b.Hash),
+			strings.Compare(a.Files[0].Path, b.Files[0].Path),
+		)
+	})
+	return result
+}
+
+// addUnique records that p has no duplicates, if unique files are being found.
+func (f *DupFinder) addUnique(p pathWithSize) {
+	if f.findMode != findModeUnique {
+		return
+	}
+	f.uniqueMutex.Lock()
+	defer f.uniqueMutex.Unlock()
+	f.unique = append(f.unique, p)
+}
+
+// addSymlink records that the symlink at path resolves to the regular file
+// targetInfo.
+func (f *DupFinder) addSymlink(path string, targetInfo fs.FileInfo) {
+	inode, _, ok := inodeAndNlink(targetInfo)
+	if !ok {
+		return
+	}
+	f.symlinksMutex.Lock()
+	defer f.symlinksMutex.Unlock()
+	f.symlinks[inode] = append(f.symlinks[inode], path)
+}
+
+// bytesRead returns the number of bytes of a file of the given size that have
+// been read after stage.
+func (f *DupFinder) bytesRead(stage hashStage, size int64) int64 {
+	switch {
+	case stage == hashStageHead || size <= 2*f.blockSize:
+		return min(size, f.blockSize)
+	case stage == hashStageTail:
+		return 2 * f.blockSize
+	default:
+		return size
+	}
+}
+
+// deviceSemaphore returns the semaphore that limits the number of files on dev
+// that are hashed concurrently, across all stages. Its capacity is the
+// device's concurrency.
+func (f *DupFinder) deviceSemaphore(dev uint64) chan struct{} {
+	f.deviceMutex.Lock()
+	defer f.deviceMutex.Unlock()
+	deviceSemaphore, ok := f.deviceSemaphores[dev]
+	if !ok {
+		concurrency := min(max(1, f.deviceConcurrency(dev, isRotational(dev))), f.hashConcurrency)
+		deviceSemaphore = make(chan struct{}, concurrency)
+		f.deviceSemaphores[dev] = deviceSemaphore
+	}
+	return deviceSemaphore
+}
+
+// eliminate updates the statistics for stage with the paths in sizeClass that
+// do not collide with at least threshold other paths.
+func (f *DupFinder) eliminate(stage hashStage, sizeClass *sizeClass, threshold int) {
+	stageStatistics := &f.statistics.stages[stage]
+	for _, pathsWithHash := range sizeClass.pathsByHash {
+		if len(pathsWithHash) >= threshold {
+			continue
+		}
+		for _, p := range pathsWithHash {
+			f.addUnique(p.pathWithSize)
+			stageStatistics.filesEliminated.Add(1)
+			stageStatistics.bytesSaved.Add(uint64(p.size - f.bytesRead(stage, p.size))) //nolint:gosec
+		}
+	}
+}
+
+// findFiles finds duplicate files according to findMode.
+func (f *DupFinder) findFiles(ctx context.Context, findMode findMode) (*Result, error) {
+	if f.progressFunc != nil {
+		defer f.reportProgress()()
+	}
+
+	// Every goroutine is cancelled and waited for before returning, so no
+	// goroutine outlives this call. Errors are sent to errCh, which is never
+	// closed, and goroutines stop sending once ctx is done.
+	ctx, cancel := context.WithCancelCause(ctx)
+	var wg sync.WaitGroup
+	defer func() {
+		cancel(nil)
+		wg.Wait()
+	}()
 	errCh := make(chan error, f.channelBufferCapacity)
-	defer close(errCh)
+
+	f.errors = nil
+	f.hardlinks = make(map[inode][]pathWithSize)
+	f.symlinks = make(map[inode][]string)
+	f.visited = make(map[inode]struct{})
+	f.referenceCopies = make(map[inode]pathWithSize)
+	f.workingDir, _ = os.Getwd()
+	f.resolvedRoots = nil
+	if f.followSymlinks {
+		for _, root := range slices.Concat(f.roots, f.referenceRoots) {
+			if resolvedRoot, err := resolvePath(root); err == nil {
+				f.resolvedRoots = append(f.resolvedRoots, resolvedRoot)
+			}
+		}
+	}
+	f.hardlinkHashes = make(map[HashCacheKey]*memoizedHash)
+
+	// Unless finding duplicates, every file that has a duplicate is needed,
+	// whatever the threshold.
+	f.findMode = findMode
+	threshold := f.threshold
+	if findMode != findModeDuplicates {
+		threshold = 2
+	}
+	f.tree = nil
+	if findMode == findModeDirectories {
+		f.tree = newTree()
+	}
+	f.unique = nil
 
 	// Generate paths with size.
 	regularFilesCh := make(chan pathWithSize, f.channelBufferCapacity)
-	go func() {
+	wg.Go(func() {
 		defer close(regularFilesCh)
-		var wg sync.WaitGroup
-		for _, root := range f.roots {
-			wg.Go(func() {
-				f.findRegularFiles(root, regularFilesCh, errCh)
+		var rootsWG sync.WaitGroup
+		for _, root := range slices.Concat(f.roots, f.referenceRoots) {
+			rootsWG.Go(func() {
+				f.findRegularFiles(ctx, root, regularFilesCh, errCh)
 			})
 		}
-		wg.Wait()
-	}()
+		rootsWG.Wait()
+	})
 
 	// Generate unique paths with size.
 	uniquePathsWithSizeCh := make(chan pathWithSize, f.channelBufferCapacity)
-	go func() {
+	wg.Go(func() {
 		defer close(uniquePathsWithSizeCh)
-		f.findUniquePathsWithSize(uniquePathsWithSizeCh, regularFilesCh)
-	}()
+		f.findUniquePathsWithSize(ctx, uniquePathsWithSizeCh, regularFilesCh)
+	})
 
 	// Generate paths with size to hash.
-	pathsToHashCh := make(chan pathWithSize, f.channelBufferCapacity)
-	go func() {
+	pathsToHashCh := make(chan pathWithHash, f.channelBufferCapacity)
+	wg.Go(func() {
 		defer close(pathsToHashCh)
-		f.findPathsWithIdenticalSizes(pathsToHashCh, uniquePathsWithSizeCh, f.threshold)
-	}()
+		f.findPathsWithIdenticalSizes(ctx, pathsToHashCh, uniquePathsWithSizeCh, threshold)
+	})
 
-	// Prioritize larger files. Use an un-buffered channel so that we accumulate
-	// as many pathWithSizes as possible before sending the path with the
-	// largest size.
-	prioritizedPathsToHashCh := heap.PriorityChannel(ctx, pathsToHashCh, func(a, b pathWithSize) bool {
-		return a.size > b.size
+	// Hash the first block of each file.
+	headHashesCh := make(chan pathWithHash, f.channelBufferCapacity)
+	wg.Go(func() {
+		defer close(headHashesCh)
+		f.hashPaths(ctx, hashStageHead, headHashesCh, pathsToHashCh, errCh)
+	})
+	headCollisionsCh := make(chan pathWithHash, f.channelBufferCapacity)
+	wg.Go(func() {
+		defer close(headCollisionsCh)
+		f.findPathsWithIdenticalHashes(ctx, hashStageHead, headCollisionsCh, headHashesCh, threshold)
 	})
 
-	// Generate paths with hashes.
+	// Hash the last block of each file whose first block collides.
+	tailHashesCh := make(chan pathWithHash, f.channelBufferCapacity)
+	wg.Go(func() {
+		defer close(tailHashesCh)
+		f.hashPaths(ctx, hashStageTail, tailHashesCh, headCollisionsCh, errCh)
+	})
+	tailCollisionsCh := make(chan pathWithHash, f.channelBufferCapacity)
+	wg.Go(func() {
+		defer close(tailCollisionsCh)
+		f.findPathsWithIdenticalHashes(ctx, hashStageTail, tailCollisionsCh, tailHashesCh, threshold)
+	})
+
+	// Hash the entire contents of each file whose first and last blocks
+	// collide, larger files first.
 	pathsWithHashCh := make(chan pathWithHash, f.channelBufferCapacity)
-	go func() {
+	wg.Go(func() {
 		defer close(pathsWithHashCh)
-		f.hashPaths(pathsWithHashCh, prioritizedPathsToHashCh, errCh)
-	}()
-
-	// Accumulate paths by hash.
-	pathsByHash := make(map[string][]string)
-	resultCh := make(chan map[string][]string)
-	go func() {
-		defer close(resultCh)
+		f.hashPaths(ctx, hashStageFull, pathsWithHashCh, tailCollisionsCh, errCh)
+	})
 
-		for pathWithHash := range pathsWithHashCh {
-			pathsByHash[pathWithHash.hash] = append(pathsByHash[pathWithHash.hash], pathWithHash.path)
-		}
+	f.setQueues([]queue{
+		newQueue("regular_files", regularFilesCh),
+		newQueue("unique_paths", uniquePathsWithSizeCh),
+		newQueue("paths_to_hash", pathsToHashCh),
+		newQueue("head_hashes", headHashesCh),
+		newQueue("head_collisions", headCollisionsCh),
+		newQueue("tail_hashes", tailHashesCh),
+		newQueue("tail_collisions", tailCollisionsCh),
+		newQueue("full_hashes", pathsWithHashCh),
+	})
+	defer f.setQueues(nil)
 
-		// Find all duplicates, indexed by hex string of their checksum.
-		result := make(map[string][]string, len(pathsByHash))
-		for hash, paths := range pathsByHash {
-			if len(paths) >= f.threshold {
-				slices.Sort(paths)
-				result[hex.EncodeToString([]byte(hash))] = paths
-			}
-		}
-		resultCh <- result
-	}()
+	// Accumulate paths by hash, reporting groups of duplicates as soon as
+	// they are final.
+	resultCh := make(chan *Result)
+	wg.Go(func() {
+		send(ctx, resultCh, f.accumulateGroups(ctx, pathsWithHashCh, threshold, errCh))
+	})
 
-	// Wait for all goroutines to finish.
+	// Handle errors until the result is ready. If the error handler returns
+	// an error then cancel all goroutines.
 	for {
 		select {
+		case <-ctx.Done():
+			return nil, context.Cause(ctx)
 		case err := <-errCh:
-			f.statistics.errors.Add(1)
-			if handledErr := f.errorHandler(err); handledErr != nil {
-				return nil, handledErr
+			if err := f.handleError(err); err != nil {
+				cancel(err)
+				return nil, err
 			}
 		case result := <-resultCh:
-			return result, nil
+			// Once all goroutines have finished, handle any remaining
+			// errors.
+			wg.Wait()
+			for {
+				select {
+				case err := <-errCh:
+					if err := f.handleError(err); err != nil {
+						return nil, err
+					}
+				default:
+					return result, nil
+				}
+			}
 		}
 	}
 }
 
-func (f *DupFinder) Statistics() *Statistics {
-	errors := f.statistics.errors.Load()
-	dirEntries := f.statistics.dirEntries.Load()
-	files := f.statistics.files.Load()
-	filesOpened := f.statistics.filesOpened.Load()
-	totalBytes := f.statistics.totalBytes.Load()
-	bytesHashed := f.statistics.bytesHashed.Load()
-	uniqueSizes := f.statistics.uniqueSizes.Load()
-
-	return &Statistics{
-		Errors:             errors,
-		DirEntries:         dirEntries,
-		Files:              files,
-		FilesOpened:        filesOpened,
-		FilesOpenedPercent: 100 * float64(filesOpened) / max(1, float64(files)),
-		TotalBytes:         totalBytes,
-		BytesHashed:        bytesHashed,
-		BytesHashedPercent: 100 * float64(bytesHashed) / max(1, float64(totalBytes)),
-		UniqueSizes:        uniqueSizes,
+// findPathsWithIdenticalHashes reads paths from pathsWithHashCh and, once
+// there are more than threshold paths with the same size and hash, writes them
+// to collisionsCh. Paths that never reach threshold are eliminated.
+func (f *DupFinder) findPathsWithIdenticalHashes(ctx context.Context, stage hashStage, collisionsCh chan<- pathWithHash, pathsWithHashCh <-chan pathWithHash, threshold int) {
+	pipelineStatistics := f.pipelineStatistics(collisionsPipelineStages[stage])
+	sizeClasses := make(sizeClasses)
+	for pathWithHash := range receive(pipelineStatistics, pathsWithHashCh) {
+		sizeClass := sizeClasses.get(pathWithHash.size)
+		if pathWithHash.done {
+			sizeClass.expected = pathWithHash.count
+		} else {
+			sizeClass.processed++
+			pathsWithHash := append(sizeClass.pathsByHash[pathWithHash.hash], pathWithHash) //nolint:gocritic
+			sizeClass.pathsByHash[pathWithHash.hash] = pathsWithHash
+			if len(pathsWithHash) == threshold {
+				for _, p := range pathsWithHash {
+					if !sendToQueue(ctx, pipelineStatistics, collisionsCh, p) {
+						return
+					}
+				}
+				sizeClass.sent += threshold
+			} else if len(pathsWithHash) > threshold {
+				if !sendToQueue(ctx, pipelineStatistics, collisionsCh, pathWithHash) {
+					return
+				}
+				sizeClass.sent++
+			}
+		}
+		if sizeClass.complete() {
+			f.eliminate(stage, sizeClass, threshold)
+			if sizeClass.sent > 0 && !sendToQueue(ctx, pipelineStatistics, collisionsCh, doneMarker(pathWithHash.size, sizeClass.sent)) {
+				return
+			}
+			delete(sizeClasses, pathWithHash.size)
+		}
+	}
+	for _, sizeClass := range sizeClasses {
+		f.eliminate(stage, sizeClass, threshold)
 	}
 }
 
 // findPathsWithIdenticalSizes reads paths from uniquePathsWithSize and, once
 // there are more than threshold paths with the same size, writes them to
-// pathsToHashCh.
-func (f *DupFinder) findPathsWithIdenticalSizes(pathsToHashCh chan<- pathWithSize, uniquePathsWithSize <-chan pathWithSize, threshold int) {
+// pathsToHashCh. Once all paths have been read, it marks all size classes as
+// done.
+func (f *DupFinder) findPathsWithIdenticalSizes(ctx context.Context, pathsToHashCh chan<- pathWithHash, uniquePathsWithSize <-chan pathWithSize, threshold int) {
+	pipelineStatistics := f.pipelineStatistics(pipelineStageSizes)
 	allPathsBySize := make(map[int64][]pathWithSize)
-	for pathWithSize := range uniquePathsWithSize {
+	for pathWithSize := range receive(pipelineStatistics, uniquePathsWithSize) {
 		pathsBySize := append(allPathsBySize[pathWithSize.size], pathWithSize) //nolint:gocritic
 		allPathsBySize[pathWithSize.size] = pathsBySize
 		if len(pathsBySize) == threshold {
 			for _, p := range pathsBySize {
-				pathsToHashCh <- p
+				if !sendToQueue(ctx, pipelineStatistics, pathsToHashCh, pathWithHash{pathWithSize: p}) {
+					return
+				}
+				f.statistics.candidates.Add(1)
 			}
 		} else if len(pathsBySize) > threshold {
-			pathsToHashCh <- pathWithSize
+			if !sendToQueue(ctx, pipelineStatistics, pathsToHashCh, pathWithHash{pathWithSize: pathWithSize}) {
+				return
+			}
+			f.statistics.candidates.Add(1)
 		}
 	}
 	f.statistics.uniqueSizes.Add(uint64(len(allPathsBySize)))
+	for size, pathsBySize := range allPathsBySize {
+		if len(pathsBySize) >= threshold {
+			if !sendToQueue(ctx, pipelineStatistics, pathsToHashCh, doneMarker(size, len(pathsBySize))) {
+				return
+			}
+		} else {
+			for _, p := range pathsBySize {
+				f.addUnique(f.referenceCopy(p))
+			}
+		}
+	}
 }
 
 // findRegularFiles walks root and writes all regular files and their sizes to
-// regularFilesCh.
-func (f *DupFinder) findRegularFiles(root string, regularFilesCh chan<- pathWithSize, errCh chan<- error) {
+// regularFilesCh. Errors are written to errCh and do not stop the walk, which
+// only stops if ctx is done.
+func (f *DupFinder) findRegularFiles(ctx context.Context, root string, regularFilesCh chan<- pathWithSize, errCh chan<- error) {
+	// handleError records that path could not be walked at stage because of
+	// err.
+	handleError := func(path string, stage ErrorStage, err error) {
+		if f.tree != nil {
+			f.tree.markIncomplete(path)
+		}
+		send(ctx, errCh, error(newPathError(path, stage, err)))
+	}
+	// onRootDevice returns whether fileInfo is on the same device as root,
+	// if the walk stays on one file system.
+	var rootDev uint64
+	if f.oneFileSystem {
+		if rootInfo, err := os.Stat(root); err == nil {
+			rootInode, _, _ := inodeAndNlink(rootInfo)
+			rootDev = rootInode.dev
+		}
+	}
+	onRootDevice := func(fileInfo fs.FileInfo) bool {
+		if !f.oneFileSystem {
+			return true
+		}
+		inode, _, ok := inodeAndNlink(fileInfo)
+		return !ok || inode.dev == rootDev
+	}
+	var ignoreTree *ignoreTree
+	if len(f.ignoreFiles) > 0 {
+		ignoreTree = newIgnoreTree(root, f.ignoreFiles)
+	}
+	// readIgnoreFiles reads the ignore files in dir, which is about to be
+	// walked.
+	readIgnoreFiles := func(dir string) {
+		if ignoreTree == nil {
+			return
+		}
+		ignoreTree.readDir(dir, func(path string, err error) {
+			handleError(path, ErrorStageRead, err)
+		})
+	}
 	walkDirFunc := func(path string, dirEntry fs.DirEntry, err error) error {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return ctxErr
+		}
 		if err != nil {
-			return err
+			handleError(path, ErrorStageWalk, err)
+			return nil
 		}
-		if f.includeFunc != nil && !f.includeFunc(path) {
+		if !f.includes(root, path, dirEntry.IsDir()) || ignoreTree != nil && ignoreTree.ignored(path, dirEntry.IsDir()) {
 			switch {
-			case dirEntry.Type().IsDir():
+			case dirEntry.Type().IsDir(), dirEntry.Type()&fs.ModeSymlink != 0:
 				return fs.SkipDir
 			default:
 				return nil
 			}
 		}
 		f.statistics.dirEntries.Add(1)
-		if dirEntry.Type() != 0 {
+		var fileInfo fs.FileInfo
+		switch typ := dirEntry.Type(); {
+		case typ.IsDir() && (f.followSymlinks || f.oneFileSystem):
+			dirInfo, err := dirEntry.Info()
+			if err != nil {
+				handleError(path, ErrorStageStat, err)
+				return fs.SkipDir
+			}
+			if !onRootDevice(dirInfo) || f.followSymlinks && !f.visitDirectory(dirInfo) {
+				return fs.SkipDir
+			}
+		case typ&fs.ModeSymlink != 0 && (f.followSymlinks || f.reportSymlinks):
+			statStart := time.Now()
+			targetInfo, err := fastwalk.StatDirEntry(path, dirEntry)
+			f.pipelineStatistics(pipelineStageStat).addItem(statStart)
+			switch {
+			case errors.Is(err, fs.ErrNotExist):
+				// Ignore broken symlinks.
+			case err != nil:
+				handleError(path, ErrorStageStat, err)
+				return fs.SkipDir
+			case !onRootDevice(targetInfo):
+				return fs.SkipDir
+			case f.followSymlinks && targetInfo.IsDir():
+				if f.resolvesIntoRoot(path) || !f.visitDirectory(targetInfo) {
+					return fs.SkipDir
+				}
+				readIgnoreFiles(path)
+			case f.followSymlinks && targetInfo.Mode().IsRegular():
+				fileInfo = targetInfo
+			case targetInfo.Mode().IsRegular():
+				f.addSymlink(path, targetInfo)
+			}
+		}
+		if fileInfo == nil && dirEntry.Type() != 0 {
+			if dirEntry.IsDir() {
+				readIgnoreFiles(path)
+			}
+			if f.tree != nil {
+				if err := f.tree.add(root, path, dirEntry, pathWithSize{reference: f.isReference(path)}); err != nil {
+					handleError(path, ErrorStageStat, err)
+				}
+			}
 			return nil
 		}
-		f.statistics.files.Add(1)
-		fileInfo, err := dirEntry.Info()
-		if err != nil {
-			return err
+		if fileInfo == nil {
+			statStart := time.Now()
+			fileInfo, err = dirEntry.Info()
+			f.pipelineStatistics(pipelineStageStat).addItem(statStart)
+			if err != nil {
+				f.statistics.files.Add(1)
+				handleError(path, ErrorStageStat, err)
+				return nil
+			}
+			if !onRootDevice(fileInfo) {
+				return nil
+			}
+		}
+		// Skip files outside the size and modification time limits before
+		// they cost any memory or hashing.
+		if !f.withinLimits(fileInfo) {
+			return nil
 		}
+		f.statistics.files.Add(1)
 		size := fileInfo.Size()
 		f.statistics.totalBytes.Add(uint64(size)) //nolint:gosec
-		regularFilesCh <- pathWithSize{
-			path: path,
-			size: size,
+		inode, nlink, _ := inodeAndNlink(fileInfo)
+		p := pathWithSize{
+			path:      path,
+			root:      root,
+			reference: f.isReference(path),
+			size:      size,
+			mode:      fileInfo.Mode(),
+			inode:     inode,
+			nlink:     nlink,
+			modTime:   fileInfo.ModTime().UnixNano(),
+		}
+		if f.tree != nil {
+			if err := f.tree.add(root, path, dirEntry, p); err != nil {
+				handleError(path, ErrorStageStat, err)
+				return nil
+			}
+		}
+		if !sendToQueue(ctx, f.pipelineStatistics(pipelineStageWalk), regularFilesCh, p) {
+			return ctx.Err()
+		}
+		if f.archiveDepth > 0 {
+			return f.scanArchiveFile(ctx, root, p, regularFilesCh, func(path string, err error) {
+				send(ctx, errCh, error(newPathError(path, ErrorStageRead, err)))
+			})
 		}
 		return nil
 	}
-	if err := fastwalk.Walk(nil, root, walkDirFunc); err != nil {
-		errCh <- err
+	walkStart := time.Now()
+	defer f.pipelineStatistics(pipelineStageWalk).addItem(walkStart)
+	config := fastwalk.DefaultConfig
+	config.Follow = f.followSymlinks
+	if err := fastwalk.Walk(&config, root, walkDirFunc); err != nil && ctx.Err() == nil {
+		send(ctx, errCh, error(newPathError(root, ErrorStageWalk, err)))
 	}
 }
 
 // findUniquePathsWithSize reads paths from regularFilesCh and not-seen-before
-// ones to uniquePathsWithSize.
-func (f *DupFinder) findUniquePathsWithSize(uniquePathsWithSizeCh chan<- pathWithSize, regularFilesCh <-chan pathWithSize) {
-	allPaths := make(map[pathWithSize]struct{})
-	for pathWithSize := range regularFilesCh {
-		if _, ok := allPaths[pathWithSize]; !ok {
-			allPaths[pathWithSize] = struct{}{}
-			uniquePathsWithSizeCh <- pathWithSize
+// ones to uniquePathsWithSize. It also records hard links and, unless
+// hard links are reported as duplicates, only writes the first path seen for
+// each file.
+func (f *DupFinder) findUniquePathsWithSize(ctx context.Context, uniquePathsWithSizeCh chan<- pathWithSize, regularFilesCh <-chan pathWithSize) {
+	allPaths := make(map[string]struct{})
+	allInodes := make(map[inode]bool)
+	pipelineStatistics := f.pipelineStatistics(pipelineStageUnique)
+	for pathWithSize := range receive(pipelineStatistics, regularFilesCh) {
+		// The same file can be reached through different paths if roots
+		// overlap, for example ./a/b and a/b. A file with a single link has
+		// only one path, so files with the same inode are the same file, and
+		// if any of its paths is in a reference root then that path is
+		// reported, see referenceCopy. Otherwise, compare absolute paths,
+		// which are either all in a reference root or all not.
+		if pathWithSize.nlink == 1 && pathWithSize.inode.ino != 0 && !f.followSymlinks {
+			if reference, ok := allInodes[pathWithSize.inode]; ok {
+				if pathWithSize.reference && !reference {
+					f.referenceCopies[pathWithSize.inode] = pathWithSize
+				}
+				continue
+			}
+			allInodes[pathWithSize.inode] = pathWithSize.reference
+		} else {
+			absPath := f.absPath(pathWithSize.path)
+			if _, ok := allPaths[absPath]; ok {
+				continue
+			}
+			allPaths[absPath] = struct{}{}
+		}
+		// When following symlinks, any file might also be reached through a
+		// symlink, so treat every file as if it had several hard links.
+		if pathWithSize.nlink > 1 || f.followSymlinks && pathWithSize.inode.ino != 0 {
+			pathsWithSize, ok := f.hardlinks[pathWithSize.inode]
+			f.hardlinks[pathWithSize.inode] = append(pathsWithSize, pathWithSize)
+			if ok {
+				f.statistics.hardlinks.Add(1)
+				if f.hardlinkMode != HardlinkModeDuplicates {
+					continue
+				}
+			}
+		}
+		if !sendToQueue(ctx, pipelineStatistics, uniquePathsWithSizeCh, pathWithSize) {
+			return
 		}
 	}
 }
 
-// hashPath returns p's hash.
-func (f *DupFinder) hashPath(p pathWithSize) (string, error) {
-	if p.size == 0 {
-		return f.emptyHash, nil
+// groupSymlinks returns the symlinks that resolve to files, sorted.
+func (f *DupFinder) groupSymlinks(files []File) []string {
+	var symlinks []string
+	for _, file := range files {
+		symlinks = append(symlinks, f.symlinks[inode{dev: file.Dev, ino: file.Ino}]...)
 	}
-	f.statistics.filesOpened.Add(1)
-	file, err := os.Open(p.path)
+	slices.Sort(symlinks)
+	return slices.Compact(symlinks)
+}
+
+// handleError counts err and passes it to the error handler, returning the
+// error handler's result. PathErrors that are handled are recorded.
+func (f *DupFinder) handleError(err error) error {
+	f.statistics.errors.Add(1)
+	if err := f.errorHandler(err); err != nil {
+		return err
+	}
+	var pathError *PathError
+	if errors.As(err, &pathError) {
+		f.errors = append(f.errors, pathError)
+	}
+	return nil
+}
+
+// hashFile returns the hash of length bytes of the file p starting at offset.
+// Files with multiple hard links, or that might be reached through symlinks,
+// are only hashed once. Archive members are hashed when their archives are
+// scanned, so their hashes are returned without reading them.
+func (f *DupFinder) hashFile(ctx context.Context, stage hashStage, p pathWithSize, offset, length int64) (string, error) {
+	if p.member != nil {
+		return p.member.hashes[stage], nil
+	}
+	length = min(length, p.size-offset)
+	if p.inode.ino == 0 {
+		return f.hashFileContents(ctx, stage, p, offset, length)
+	}
+	key := HashCacheKey{
+		Dev:       p.inode.dev,
+		Ino:       p.inode.ino,
+		Size:      p.size,
+		ModTimeNs: p.modTime,
+		Algorithm: f.hashCacheAlgorithm,
+		Offset:    offset,
+		Length:    length,
+	}
+	if p.nlink <= 1 && !f.followSymlinks {
+		return f.hashFileWithCache(ctx, stage, p, key)
+	}
+	f.hardlinkHashesMutex.Lock()
+	hardlinkHash, ok := f.hardlinkHashes[key]
+	if !ok {
+		hardlinkHash = &memoizedHash{}
+		f.hardlinkHashes[key] = hardlinkHash
+	}
+	f.hardlinkHashesMutex.Unlock()
+	hardlinkHash.once.Do(func() {
+		hardlinkHash.hash, hardlinkHash.err = f.hashFileWithCache(ctx, stage, p, key)
+	})
+	return hardlinkHash.hash, hardlinkHash.err
+}
+
+// hashFileWithCache returns the hash of the range of bytes of the file p
+// identified by key, using the hash cache if possible.
+func (f *DupFinder) hashFileWithCache(ctx context.Context, stage hashStage, p pathWithSize, key HashCacheKey) (string, error) {
+	if f.hashCache == nil {
+		return f.hashFileContents(ctx, stage, p, key.Offset, key.Length)
+	}
+	if hash, ok := f.hashCache.Get(key); ok {
+		f.statistics.cacheHits.Add(1)
+		return hash, nil
+	}
+	f.statistics.cacheMisses.Add(1)
+	hash, err := f.hashFileContents(ctx, stage, p, key.Offset, key.Length)
 	if err != nil {
 		return "", err
 	}
+	f.hashCache.Set(key, hash)
+	return hash, nil
+}
+
+// hashFileContents returns the hash of length bytes of the file p, starting at
+// offset. The file is read in chunks so that hashing large files stops soon
+// after ctx is done.
+func (f *DupFinder) hashFileContents(ctx context.Context, stage hashStage, p pathWithSize, offset, length int64) (string, error) {
+	if stage == hashStageHead {
+		// Count each file once, when it is first opened.
+		f.statistics.filesOpened.Add(1)
+	}
+	deviceSemaphore := f.deviceSemaphore(p.inode.dev)
+	if !send(ctx, deviceSemaphore, struct{}{}) {
+		return "", ctx.Err()
+	}
+	defer func() {
+		<-deviceSemaphore
+	}()
+	if !send(ctx, f.openFiles, struct{}{}) {
+		return "", ctx.Err()
+	}
+	defer func() {
+		<-f.openFiles
+	}()
+	start := time.Now()
+	file, err := os.Open(p.path)
+	if err != nil {
+		return "", newPathError(p.path, ErrorStageOpen, err)
+	}
 	defer file.Close()
 	hash := f.newHashFunc()
-	written, err := io.Copy(hash, file)
-	if err != nil {
-		return "", err
+	sectionReader := io.NewSectionReader(file, offset, length)
+	var written int64
+	for {
+		if err := ctx.Err(); err != nil {
+			return "", err
+		}
+		n, err := io.Copy(hash, io.LimitReader(sectionReader, hashChunkSize))
+		written += n
+		if err != nil {
+			return "", newPathError(p.path, ErrorStageRead, err)
+		}
+		if n < hashChunkSize {
+			break
+		}
 	}
 	f.statistics.bytesHashed.Add(uint64(written)) //nolint:gosec
+	stageStatistics := &f.statistics.stages[stage]
+	stageStatistics.hashLatency.observe(time.Since(start))
+	stageStatistics.filesHashed.Add(1)
+	stageStatistics.bytesHashed.Add(uint64(written)) //nolint:gosec
 	return string(hash.Sum(nil)), nil
 }
 
-// hashPaths reads paths from pathsToHashCh, computes their hashes, and writes
-// them to pathsWithHashCh.
-func (f *DupFinder) hashPaths(pathsWithHashCh chan<- pathWithHash, pathsToHashCh <-chan pathWithSize, errCh chan<- error) {
-	var wg sync.WaitGroup
-	for pathWithSize := range pathsToHashCh {
-		wg.Go(func() {
-			hash, err := f.hashPath(pathWithSize)
+// hashLength returns the number of bytes of p that are read by hashPath for
+// stage.
+func (f *DupFinder) hashLength(stage hashStage, p pathWithHash) int64 {
+	switch {
+	case p.complete || p.size == 0:
+		return 0
+	case stage == hashStageHead:
+		return min(p.size, f.blockSize)
+	case stage == hashStageTail:
+		if p.size <= 2*f.blockSize {
+			return 0
+		}
+		return f.blockSize
+	default:
+		return p.size
+	}
+}
+
+// hashPath returns p with its hash updated for stage.
+func (f *DupFinder) hashPath(ctx context.Context, stage hashStage, p pathWithHash) (pathWithHash, error) {
+	if p.complete {
+		return p, nil
+	}
+	switch {
+	case p.size == 0:
+		p.hash = f.emptyHash
+		p.complete = true
+	case stage == hashStageHead:
+		hash, err := f.hashFile(ctx, stage, p.pathWithSize, 0, f.blockSize)
+		if err != nil {
+			return pathWithHash{}, err
+		}
+		if p.size <= f.blockSize {
+			p.hash = hash
+			p.complete = true
+		} else {
+			p.hash += hash
+		}
+	case stage == hashStageTail:
+		// If the first and last blocks cover the entire file then skip
+		// straight to the full hash, which reads no more data.
+		if p.size <= 2*f.blockSize {
+			return p, nil
+		}
+		hash, err := f.hashFile(ctx, stage, p.pathWithSize, p.size-f.blockSize, f.blockSize)
+		if err != nil {
+			return pathWithHash{}, err
+		}
+		p.hash += hash
+	default:
+		hash, err := f.hashFile(ctx, stage, p.pathWithSize, 0, p.size)
+		if err != nil {
+			return pathWithHash{}, err
+		}
+		p.hash = hash
+		p.complete = true
+	}
+	return p, nil
+}
+
+// hashPaths reads paths from pathsToHashCh, computes their hashes for stage,
+// and writes them to pathsWithHashCh. Paths are hashed by a pool of workers
+// for each device, see [WithDeviceConcurrency].
+func (f *DupFinder) hashPaths(ctx context.Context, stage hashStage, pathsWithHashCh chan<- pathWithHash, pathsToHashCh <-chan pathWithHash, errCh chan<- error) {
+	pipelineStatistics := f.pipelineStatistics(hashPipelineStages[stage])
+	var mutex sync.Mutex
+	sizeClasses := make(sizeClasses)
+
+	// updateSizeClass calls update on the sizeClass for size and, if all of
+	// its paths have been processed, sends a done marker.
+	updateSizeClass := func(size int64, update func(*sizeClass)) {
+		mutex.Lock()
+		sizeClass := sizeClasses.get(size)
+		update(sizeClass)
+		complete := sizeClass.complete()
+		if complete {
+			delete(sizeClasses, size)
+		}
+		mutex.Unlock()
+		if complete && sizeClass.sent > 0 {
+			sendToQueue(ctx, pipelineStatistics, pathsWithHashCh, doneMarker(size, sizeClass.sent))
+		}
+	}
+
+	// hashWorker hashes the paths from deviceCh until deviceCh is closed.
+	// Once ctx is done, the remaining paths are discarded.
+	hashWorker := func(deviceCh <-chan pathWithHash) {
+		for pathToHash := range deviceCh {
+			if ctx.Err() != nil {
+				continue
+			}
+			start := time.Now()
+			pathWithHash, err := f.hashPath(ctx, stage, pathToHash)
+			f.statistics.bytesDone.Add(uint64(f.hashLength(stage, pathToHash))) //nolint:gosec
 			if err != nil {
-				errCh <- err
+				send(ctx, errCh, err)
 			} else {
-				pathsWithHashCh <- pathWithHash{
-					path: pathWithSize.path,
-					hash: hash,
+				sendToQueue(ctx, pipelineStatistics, pathsWithHashCh, pathWithHash)
+			}
+			pipelineStatistics.addItem(start)
+			updateSizeClass(pathToHash.size, func(sizeClass *sizeClass) {
+				sizeClass.processed++
+				if err == nil {
+					sizeClass.sent++
 				}
+			})
+		}
+	}
+
+	var wg sync.WaitGroup
+	deviceChs := make(map[uint64]chan<- pathWithHash)
+	defer func() {
+		for _, deviceCh := range deviceChs {
+			close(deviceCh)
+		}
+		wg.Wait()
+	}()
+	for pathToHash := range pathsToHashCh {
+		if pathToHash.done {
+			updateSizeClass(pathToHash.size, func(sizeClass *sizeClass) {
+				sizeClass.expected = pathToHash.count
+			})
+			continue
+		}
+		f.statistics.bytesQueued.Add(uint64(f.hashLength(stage, pathToHash))) //nolint:gosec
+		dev := pathToHash.inode.dev
+		deviceCh, ok := deviceChs[dev]
+		if !ok {
+			// Each device has its own bounded queue so that a slow device
+			// does not stop paths being dispatched to other devices until
+			// its queue is full. Full hashes of larger files are computed
+			// first, otherwise paths are hashed in the order in which they
+			// are received.
+			capacity := max(f.channelBufferCapacity, 1)
+			var deviceOutCh <-chan pathWithHash
+			if stage == hashStageFull {
+				deviceInCh := make(chan pathWithHash)
+				deviceCh = deviceInCh
+				deviceOutCh = priorityQueue(ctx, deviceInCh, capacity, func(a, b pathWithHash) bool {
+					return a.size > b.size
+				})
+			} else {
+				deviceInCh := make(chan pathWithHash, capacity)
+				deviceCh = deviceInCh
+				deviceOutCh = deviceInCh
+			}
+			deviceChs[dev] = deviceCh
+			for range cap(f.deviceSemaphore(dev)) {
+				wg.Go(func() {
+					hashWorker(deviceOutCh)
+				})
+			}
+		}
+		if !send(ctx, deviceCh, pathToHash) {
+			return
+		}
+	}
+}
+
+// includes returns whether path, found while walking root, is included by the
+// filter. isDir is whether path is a directory. root itself is always
+// included.
+func (f *DupFinder) includes(root, path string, isDir bool) bool {
+	if f.filter == nil || path == root {
+		return true
+	}
+	relPath, err := filepath.Rel(root, path)
+	if err != nil {
+		return true
+	}
+	return f.filter.Include(filepath.ToSlash(f.absPath(path)), filepath.ToSlash(relPath), isDir)
+}
+
+// includesReferences returns whether files include both files in reference
+// roots and files that are not, if there are any reference roots.
+func (f *DupFinder) includesReferences(files []File) bool {
+	if len(f.referenceRoots) == 0 {
+		return true
+	}
+	return slices.ContainsFunc(files, func(file File) bool {
+		return file.Reference
+	}) && slices.ContainsFunc(files, func(file File) bool {
+		return !file.Reference
+	})
+}
+
+// isReference returns whether path is in a reference root.
+func (f *DupFinder) isReference(path string) bool {
+	absPath := f.absPath(path)
+	for _, absReferenceRoot := range f.absReferenceRoots {
+		if relPath, err := filepath.Rel(absReferenceRoot, absPath); err == nil && filepath.IsLocal(relPath) {
+			return true
+		}
+	}
+	return false
+}
+
+// pipelineStatistics returns the statistics for stage.
+func (f *DupFinder) pipelineStatistics(stage pipelineStage) *pipelineStageStatistics {
+	return &f.statistics.pipeline[stage].pipelineStageStatistics
+}
+
+// referenceCopy returns the copy of p that is in a reference root, if p is
+// not in a reference root but the same file was also found in one through an
+// overlapping root. Otherwise it returns p.
+func (f *DupFinder) referenceCopy(p pathWithSize) pathWithSize {
+	if referenceCopy, ok := f.referenceCopies[p.inode]; ok {
+		return referenceCopy
+	}
+	return p
+}
+
+// reportGroups adds the groups of duplicates in sizeClass, which contains
+// paths with size, to result and reports them. keys contains the keys of the
+// groups already in result.
+func (f *DupFinder) reportGroups(ctx context.Context, result *Result, keys map[string]bool, size int64, sizeClass *sizeClass, threshold int, errCh chan<- error) {
+	f.eliminate(hashStageFull, sizeClass, threshold)
+	for _, hash := range slices.Sorted(maps.Keys(sizeClass.pathsByHash)) {
+		pathsWithHash := sizeClass.pathsByHash[hash]
+		if len(pathsWithHash) < threshold {
+			continue
+		}
+		files := make([]File, 0, len(pathsWithHash))
+		for _, pathWithHash := range pathsWithHash {
+			p := pathWithHash.pathWithSize
+			if f.hardlinkMode != HardlinkModeDuplicates && len(f.hardlinks[p.inode]) > 1 {
+				// Report the same path for each file, regardless of which
+				// hard link or symlink to it was found first.
+				p = slices.MinFunc(f.hardlinks[p.inode], func(a, b pathWithSize) int {
+					return strings.Compare(a.path, b.path)
+				})
 			}
+			files = append(files, f.referenceCopy(p).file())
+		}
+		slices.SortFunc(files, func(a, b File) int {
+			return strings.Compare(a.Path, b.Path)
 		})
+		fileGroups := [][]File{files}
+		if f.verify {
+			fileGroups = f.verifyFiles(ctx, files, errCh)
+		}
+		hexHash := hex.EncodeToString([]byte(hash))
+		for _, files := range fileGroups {
+			if len(files) < threshold {
+				for _, file := range files {
+					f.addUnique(pathWithSize{path: file.Path, root: file.Root, reference: file.Reference, size: file.Size, container: file.Container, member: file.member})
+				}
+				continue
+			}
+			if f.findMode == findModeDuplicates && !f.includesReferences(files) {
+				continue
+			}
+			key := hexHash
+			for i := 1; keys[key]; i++ {
+				key = hexHash + "-" + strconv.Itoa(i)
+			}
+			keys[key] = true
+			group := &Group{
+				Key:         key,
+				Hash:        hexHash,
+				Size:        size,
+				WastedBytes: int64(len(files)-1) * size,
+				Files:       files,
+				Symlinks:    f.groupSymlinks(files),
+			}
+			result.Groups = append(result.Groups, group)
+			result.WastedBytes += group.WastedBytes
+			if f.groupFunc != nil && f.findMode == findModeDuplicates {
+				if err := f.groupFunc(group); err != nil {
+					send(ctx, errCh, err)
+				}
+			}
+		}
+	}
+}
+
+// resolvesIntoRoot returns whether the symlink at path resolves to a path in
+// any root. Directories in roots are walked anyway, so symlinks to them are not
+// followed.
+func (f *DupFinder) resolvesIntoRoot(path string) bool {
+	resolvedPath, err := resolvePath(path)
+	if err != nil {
+		return false
+	}
+	for _, resolvedRoot := range f.resolvedRoots {
+		if relPath, err := filepath.Rel(resolvedRoot, resolvedPath); err == nil && filepath.IsLocal(relPath) {
+			return true
+		}
+	}
+	return false
+}
+
+// visitDirectory records that the directory fileInfo has been visited. It
+// returns false if it was already visited.
+func (f *DupFinder) visitDirectory(fileInfo fs.FileInfo) bool {
+	inode, _, ok := inodeAndNlink(fileInfo)
+	if !ok {
+		return true
+	}
+	f.visitedMutex.Lock()
+	defer f.visitedMutex.Unlock()
+	if _, ok := f.visited[inode]; ok {
+		return false
+	}
+	f.visited[inode] = struct{}{}
+	return true
+}
+
+// withinLimits returns whether the size and modification time of fileInfo are
+// within the limits set with [WithMinSize], [WithMaxSize],
+// [WithModifiedSince], and [WithModifiedBefore].
+func (f *DupFinder) withinLimits(fileInfo fs.FileInfo) bool {
+	size := fileInfo.Size()
+	if size < f.minSize || size > f.maxSize {
+		return false
+	}
+	modTime := fileInfo.ModTime()
+	if !f.modifiedSince.IsZero() && modTime.Before(f.modifiedSince) {
+		return false
+	}
+	if !f.modifiedBefore.IsZero() && !modTime.Before(f.modifiedBefore) {
+		return false
+	}
+	return true
+}
+
+// Paths returns the paths of the files in g.
+func (g *Group) Paths() []string {
+	paths := make([]string, 0, len(g.Files))
+	for _, file := range g.Files {
+		paths = append(paths, file.Path)
+	}
+	return paths
+}
+
+// Map returns the paths of the files in each group in r, indexed by the
+// group's key.
+func (r *Result) Map() map[string][]string {
+	m := make(map[string][]string, len(r.Groups))
+	for _, group := range r.Groups {
+		m[group.Key] = group.Paths()
+	}
+	return m
+}
+
+// SortByWastedBytes sorts the groups in r by wasted bytes, largest first.
+// Groups with the same wasted bytes are sorted by key.
+func (r *Result) SortByWastedBytes() {
+	slices.SortFunc(r.Groups, func(a, b *Group) int {
+		return cmp.Or(
+			cmp.Compare(b.WastedBytes, a.WastedBytes),
+			strings.Compare(a.Key, b.Key),
+		)
+	})
+}
+
+// file returns the File for p.
+func (p pathWithSize) file() File {
+	return File{
+		Path:      p.path,
+		Root:      p.root,
+		Reference: p.reference,
+		Size:      p.size,
+		Mode:      p.mode,
+		ModTime:   time.Unix(0, p.modTime),
+		Dev:       p.inode.dev,
+		Ino:       p.inode.ino,
+		Container: p.container,
+		member:    p.member,
+	}
+}
+
+// load returns a snapshot of s.
+func (s *stageStatistics) load() StageStatistics {
+	return StageStatistics{
+		FilesHashed:     s.filesHashed.Load(),
+		BytesHashed:     s.bytesHashed.Load(),
+		FilesEliminated: s.filesEliminated.Load(),
+		BytesSaved:      s.bytesSaved.Load(),
+	}
+}
+
+// resolvePath returns the absolute path of path with all symlinks resolved.
+func resolvePath(path string) (string, error) {
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
 	}
-	wg.Wait()
+	return filepath.EvalSymlinks(absPath)
 }
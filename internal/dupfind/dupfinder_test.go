@@ -1,19 +1,36 @@
 package dupfind_test
 
 import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
 	"crypto/sha256"
 	"crypto/sha512"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"hash"
-	"path"
+	"io"
+	"maps"
+	"os"
+	"path/filepath"
+	"runtime"
 	"slices"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/alecthomas/assert/v2"
 	"github.com/twpayne/go-vfs/v5/vfst"
 	"github.com/zeebo/xxh3"
 
 	"github.com/twpayne/find-duplicates/internal/dupfind"
+	"github.com/twpayne/find-duplicates/internal/filter"
 )
 
 func TestDupFinder(t *testing.T) {
@@ -66,6 +83,10 @@ func TestDupFinder(t *testing.T) {
 				BytesHashed:        2,
 				BytesHashedPercent: 50,
 				UniqueSizes:        2,
+				Head: dupfind.StageStatistics{
+					FilesHashed: 2,
+					BytesHashed: 2,
+				},
 			},
 		},
 		{
@@ -91,6 +112,11 @@ func TestDupFinder(t *testing.T) {
 				BytesHashed:        3,
 				BytesHashedPercent: 100,
 				UniqueSizes:        1,
+				Head: dupfind.StageStatistics{
+					FilesHashed:     3,
+					BytesHashed:     3,
+					FilesEliminated: 1,
+				},
 			},
 		},
 		{
@@ -117,6 +143,10 @@ func TestDupFinder(t *testing.T) {
 				BytesHashed:        2,
 				BytesHashedPercent: 100,
 				UniqueSizes:        1,
+				Head: dupfind.StageStatistics{
+					FilesHashed: 2,
+					BytesHashed: 2,
+				},
 			},
 		},
 		{
@@ -147,16 +177,17 @@ func TestDupFinder(t *testing.T) {
 				BytesHashed:        4,
 				BytesHashedPercent: 100,
 				UniqueSizes:        1,
+				Head: dupfind.StageStatistics{
+					FilesHashed: 4,
+					BytesHashed: 4,
+				},
 			},
 		},
 		{
 			name: "exclude_pattern",
 			options: []dupfind.Option{
 				dupfind.WithHashFunc(sha256.New),
-				dupfind.WithIncludeFunc(func(p string) bool {
-					_, basename := path.Split(p)
-					return basename != "delta"
-				}),
+				dupfind.WithFilter(mustNewFilter(t, filter.Rule{Action: filter.Exclude, Pattern: "delta"})),
 			},
 			root: map[string]any{
 				"alpha": "a",
@@ -179,16 +210,18 @@ func TestDupFinder(t *testing.T) {
 				BytesHashed:        3,
 				BytesHashedPercent: 100,
 				UniqueSizes:        1,
+				Head: dupfind.StageStatistics{
+					FilesHashed:     3,
+					BytesHashed:     3,
+					FilesEliminated: 1,
+				},
 			},
 		},
 		{
 			name: "exclude_pattern_dir",
 			options: []dupfind.Option{
 				dupfind.WithHashFunc(sha256.New),
-				dupfind.WithIncludeFunc(func(p string) bool {
-					_, basename := path.Split(p)
-					return basename != "x"
-				}),
+				dupfind.WithFilter(mustNewFilter(t, filter.Rule{Action: filter.Exclude, Pattern: "x"})),
 			},
 			root: map[string]any{
 				"alpha":   "a",
@@ -213,6 +246,129 @@ func TestDupFinder(t *testing.T) {
 				BytesHashed:        3,
 				BytesHashedPercent: 100,
 				UniqueSizes:        1,
+				Head: dupfind.StageStatistics{
+					FilesHashed: 3,
+					BytesHashed: 3,
+				},
+			},
+		},
+		{
+			name: "partial_hashes",
+			options: []dupfind.Option{
+				dupfind.WithBlockSize(2),
+				dupfind.WithHashFunc(sha256.New),
+			},
+			root: map[string]any{
+				"alpha": "aaaaaa",
+				"beta":  "aaaaaa",
+				"gamma": "baaaaa",
+				"delta": "aaaaab",
+			},
+			expected: map[string][]string{
+				"ed02457b5c41d964dbd2f2a609d63fe1bb7528dbe55e1abf5b52c249cd735797": {
+					"alpha",
+					"beta",
+				},
+			},
+			expectedStatistics: &dupfind.Statistics{
+				DirEntries:         5,
+				Files:              4,
+				FilesOpened:        4,
+				FilesOpenedPercent: 100,
+				TotalBytes:         24,
+				BytesHashed:        26,
+				BytesHashedPercent: 100 * 26. / 24,
+				UniqueSizes:        1,
+				Head: dupfind.StageStatistics{
+					FilesHashed:     4,
+					BytesHashed:     8,
+					FilesEliminated: 1,
+					BytesSaved:      4,
+				},
+				Tail: dupfind.StageStatistics{
+					FilesHashed:     3,
+					BytesHashed:     6,
+					FilesEliminated: 1,
+					BytesSaved:      2,
+				},
+				Full: dupfind.StageStatistics{
+					FilesHashed: 2,
+					BytesHashed: 12,
+				},
+			},
+		},
+		{
+			name: "partial_hashes_skip_tail",
+			options: []dupfind.Option{
+				dupfind.WithBlockSize(4),
+				dupfind.WithHashFunc(sha256.New),
+			},
+			root: map[string]any{
+				"alpha": "aaaaa",
+				"beta":  "aaaaa",
+			},
+			expected: map[string][]string{
+				"ed968e840d10d2d313a870bc131a4e2c311d7ad09bdf32b3418147221f51a6e2": {
+					"alpha",
+					"beta",
+				},
+			},
+			expectedStatistics: &dupfind.Statistics{
+				DirEntries:         3,
+				Files:              2,
+				FilesOpened:        2,
+				FilesOpenedPercent: 100,
+				TotalBytes:         10,
+				BytesHashed:        18,
+				BytesHashedPercent: 180,
+				UniqueSizes:        1,
+				Head: dupfind.StageStatistics{
+					FilesHashed: 2,
+					BytesHashed: 8,
+				},
+				Full: dupfind.StageStatistics{
+					FilesHashed: 2,
+					BytesHashed: 10,
+				},
+			},
+		},
+		{
+			name: "verify",
+			options: []dupfind.Option{
+				dupfind.WithHashFunc(newConstantHash),
+				dupfind.WithVerify(true),
+			},
+			root: map[string]any{
+				"alpha":   "a",
+				"beta":    "b",
+				"gamma":   "a",
+				"delta":   "b",
+				"epsilon": "c",
+			},
+			expected: map[string][]string{
+				"00": {
+					"alpha",
+					"gamma",
+				},
+				"00-1": {
+					"beta",
+					"delta",
+				},
+			},
+			expectedStatistics: &dupfind.Statistics{
+				DirEntries:         6,
+				Files:              5,
+				FilesOpened:        5,
+				FilesOpenedPercent: 100,
+				TotalBytes:         5,
+				BytesHashed:        5,
+				BytesHashedPercent: 100,
+				UniqueSizes:        1,
+				Collisions:         2,
+				Head: dupfind.StageStatistics{
+					FilesHashed: 5,
+					BytesHashed: 5,
+				},
 			},
 		},
 		{
@@ -239,6 +395,10 @@ func TestDupFinder(t *testing.T) {
 				BytesHashed:        2,
 				BytesHashedPercent: 100,
 				UniqueSizes:        1,
+				Head: dupfind.StageStatistics{
+					FilesHashed: 2,
+					BytesHashed: 2,
+				},
 			},
 		},
 		{
@@ -265,6 +425,10 @@ func TestDupFinder(t *testing.T) {
 				BytesHashed:        2,
 				BytesHashedPercent: 100,
 				UniqueSizes:        1,
+				Head: dupfind.StageStatistics{
+					FilesHashed: 2,
+					BytesHashed: 2,
+				},
 			},
 		},
 		{
@@ -291,6 +455,10 @@ func TestDupFinder(t *testing.T) {
 				BytesHashed:        2,
 				BytesHashedPercent: 100,
 				UniqueSizes:        1,
+				Head: dupfind.StageStatistics{
+					FilesHashed: 2,
+					BytesHashed: 2,
+				},
 			},
 		},
 	} {
@@ -309,12 +477,1813 @@ func TestDupFinder(t *testing.T) {
 			assert.Equal(t, tc.expected, trimValuePrefixes(actual, fs.TempDir()+"/"))
 
 			if tc.expectedStatistics != nil {
-				assert.Equal(t, tc.expectedStatistics, dupFinder.Statistics())
+				assert.Equal(t, tc.expectedStatistics, countStatistics(dupFinder))
+			}
+		})
+	}
+}
+
+func TestDupFinderFindSimilarDirectories(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		root func(string) string
+	}{
+		{
+			name: "absolute",
+			root: func(tempDir string) string {
+				return tempDir
+			},
+		},
+		{
+			name: "dot",
+			root: func(string) string {
+				return "."
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := t.Context()
+
+			fs, cleanup, err := vfst.NewTestFS(map[string]any{
+				"photos1": map[string]any{
+					"a.jpg": "aaaaaaaa",
+					"b.jpg": "bbbbbbbb",
+					"c.jpg": "cc",
+				},
+				"photos2": map[string]any{
+					"a.jpg":      "aaaaaaaa",
+					"b-copy.jpg": "bbbbbbbb",
+					"d.jpg":      "dddd",
+				},
+				"other": map[string]any{
+					"a.jpg": "aaaaaaaa",
+					"e.jpg": "eeeeeeeeeeeeeeeeeeeeeeee",
+				},
+			})
+			assert.NoError(t, err)
+			defer cleanup()
+			t.Chdir(fs.TempDir())
+
+			dupFinder := dupfind.NewDupFinder(
+				dupfind.WithHashFunc(sha256.New),
+				dupfind.WithRoots(tc.root(fs.TempDir())),
+				dupfind.WithThreshold(3),
+			)
+			actual, err := dupFinder.FindSimilarDirectories(ctx, 0.5)
+			assert.NoError(t, err)
+			for _, similarDirectories := range actual {
+				similarDirectories.A = strings.TrimPrefix(similarDirectories.A, fs.TempDir()+"/")
+				similarDirectories.B = strings.TrimPrefix(similarDirectories.B, fs.TempDir()+"/")
+				similarDirectories.OnlyInA = trimPrefixes(similarDirectories.OnlyInA, fs.TempDir()+"/")
+				similarDirectories.OnlyInB = trimPrefixes(similarDirectories.OnlyInB, fs.TempDir()+"/")
+			}
+			assert.Equal(t, []*dupfind.SimilarDirectories{
+				{
+					A:           "photos1",
+					B:           "photos2",
+					Similarity:  16.0 / 22.0,
+					CommonBytes: 16,
+					TotalBytes:  22,
+					OnlyInA:     []string{"photos1/c.jpg"},
+					OnlyInB:     []string{"photos2/d.jpg"},
+				},
+			}, actual)
+		})
+	}
+}
+
+func TestDupFinderFindSimilarDirectoriesMinSimilarity(t *testing.T) {
+	ctx := t.Context()
+
+	root := make(map[string]any)
+	for i := range 8 {
+		// Every directory contains the same small file, and some contents in
+		// common with its neighbors.
+		directory := map[string]any{
+			"LICENSE": "license",
+		}
+		for j := i; j < i+4; j++ {
+			directory["file"+strconv.Itoa(j)] = strings.Repeat(strconv.Itoa(j%10), 10*(j+1))
+		}
+		root["dir"+strconv.Itoa(i)] = directory
+	}
+	fs, cleanup, err := vfst.NewTestFS(root)
+	assert.NoError(t, err)
+	defer cleanup()
+
+	dupFinder := dupfind.NewDupFinder(
+		dupfind.WithHashFunc(sha256.New),
+		dupfind.WithRoots(fs.TempDir()),
+	)
+	allSimilarDirectories, err := dupFinder.FindSimilarDirectories(ctx, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, 8*7/2, len(allSimilarDirectories))
+
+	for _, minSimilarity := range []float64{0.1, 0.25, 0.4, 0.5, 0.6} {
+		dupFinder := dupfind.NewDupFinder(
+			dupfind.WithHashFunc(sha256.New),
+			dupfind.WithRoots(fs.TempDir()),
+		)
+		actual, err := dupFinder.FindSimilarDirectories(ctx, minSimilarity)
+		assert.NoError(t, err)
+		expected := slices.DeleteFunc(slices.Clone(allSimilarDirectories), func(similarDirectories *dupfind.SimilarDirectories) bool {
+			return similarDirectories.Similarity < minSimilarity
+		})
+		assert.Equal(t, expected, actual)
+	}
+}
+
+func TestDupFinderReferenceRoots(t *testing.T) {
+	ctx := t.Context()
+
+	fs, cleanup, err := vfst.NewTestFS(map[string]any{
+		"archive": map[string]any{
+			"a":  "a",
+			"a2": "a",
+			"b":  "bb",
+		},
+		"dump": map[string]any{
+			"b":  "bb",
+			"b2": "bb",
+			"c":  "ccc",
+			"c2": "ccc",
+		},
+	})
+	assert.NoError(t, err)
+	defer cleanup()
+
+	archive := filepath.Join(fs.TempDir(), "archive")
+	for _, roots := range [][]string{
+		{filepath.Join(fs.TempDir(), "dump")},
+		{fs.TempDir()},
+	} {
+		dupFinder := dupfind.NewDupFinder(
+			dupfind.WithHashFunc(sha256.New),
+			dupfind.WithReferenceRoots(archive),
+			dupfind.WithRoots(roots...),
+		)
+		result, err := dupFinder.Find(ctx)
+		assert.NoError(t, err)
+		assert.Equal(t, 1, len(result.Groups))
+		var references []bool
+		for _, file := range result.Groups[0].Files {
+			references = append(references, file.Reference)
+		}
+		assert.Equal(t, []string{"archive/b", "dump/b", "dump/b2"}, trimPrefixes(result.Groups[0].Paths(), fs.TempDir()+"/"))
+		assert.Equal(t, []bool{true, false, false}, references)
+	}
+}
+
+func TestDupFinderReferenceRootsSpelling(t *testing.T) {
+	for _, tc := range []struct {
+		name           string
+		referenceRoots func(string) []string
+		roots          func(string) []string
+	}{
+		{
+			name: "relative_reference_root",
+			referenceRoots: func(string) []string {
+				return []string{"archive", "other"}
+			},
+			roots: func(tempDir string) []string {
+				return []string{filepath.Join(tempDir, "archive", "many"), "dump"}
+			},
+		},
+		{
+			name: "absolute_reference_root",
+			referenceRoots: func(tempDir string) []string {
+				return []string{filepath.Join(tempDir, "archive"), "other"}
+			},
+			roots: func(string) []string {
+				return []string{"./archive/many/", "dump"}
+			},
+		},
+		{
+			name: "overlapping_root",
+			referenceRoots: func(string) []string {
+				return []string{"./archive/", "other"}
+			},
+			roots: func(tempDir string) []string {
+				return []string{tempDir}
+			},
+		},
+		{
+			name: "symlink",
+			referenceRoots: func(string) []string {
+				return []string{"archive", "other"}
+			},
+			roots: func(string) []string {
+				return []string{"link/", "dump"}
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := t.Context()
+
+			many := make(map[string]any)
+			dump := make(map[string]any)
+			for i := range 64 {
+				many["file"+strconv.Itoa(i)] = "contents" + strconv.Itoa(i)
+				dump["file"+strconv.Itoa(i)] = "contents" + strconv.Itoa(i)
+			}
+			fs, cleanup, err := vfst.NewTestFS(map[string]any{
+				"archive": map[string]any{
+					"many": many,
+				},
+				"dump": dump,
+				"link": &vfst.Symlink{Target: "archive"},
+				// other is walked first, so that files in archive are
+				// likely to be found through the other roots first.
+				"other": map[string]any{
+					"file": "other",
+				},
+			})
+			assert.NoError(t, err)
+			defer cleanup()
+			t.Chdir(fs.TempDir())
+
+			dupFinder := dupfind.NewDupFinder(
+				dupfind.WithHashFunc(sha256.New),
+				dupfind.WithReferenceRoots(tc.referenceRoots(fs.TempDir())...),
+				dupfind.WithRoots(tc.roots(fs.TempDir())...),
+			)
+			result, err := dupFinder.Find(ctx)
+			assert.NoError(t, err)
+			assert.Equal(t, 64, len(result.Groups))
+			for _, group := range result.Groups {
+				var relPaths []string
+				for _, file := range group.Files {
+					path := file.Path
+					if !filepath.IsAbs(path) {
+						path = filepath.Join(fs.TempDir(), path)
+					}
+					relPath, err := filepath.Rel(fs.TempDir(), path)
+					assert.NoError(t, err)
+					relPaths = append(relPaths, filepath.ToSlash(relPath))
+					assert.Equal(t, strings.HasPrefix(relPath, "archive"), file.Reference, relPath)
+				}
+				slices.Sort(relPaths)
+				assert.Equal(t, 2, len(relPaths))
+				assert.True(t, strings.HasPrefix(relPaths[0], "archive/many/"))
+				assert.True(t, strings.HasPrefix(relPaths[1], "dump/"))
+			}
+		})
+	}
+}
+
+func TestDupFinderFindUnique(t *testing.T) {
+	ctx := t.Context()
+
+	fs, cleanup, err := vfst.NewTestFS(map[string]any{
+		"archive": map[string]any{
+			"a2": "aa",
+			"e":  "ee",
+			"x":  "xxx",
+		},
+		"incoming": map[string]any{
+			"a":  "aa",
+			"b":  "b",
+			"c":  "cc",
+			"c2": "cc",
+			"d":  "dd",
+		},
+	})
+	assert.NoError(t, err)
+	defer cleanup()
+
+	archive := filepath.Join(fs.TempDir(), "archive")
+	incoming := filepath.Join(fs.TempDir(), "incoming")
+	uniquePaths := func(files []dupfind.File) []string {
+		paths := make([]string, 0, len(files))
+		for _, file := range files {
+			paths = append(paths, strings.TrimPrefix(file.Path, fs.TempDir()+"/"))
+		}
+		return paths
+	}
+
+	t.Run("reference", func(t *testing.T) {
+		dupFinder := dupfind.NewDupFinder(
+			dupfind.WithHashFunc(sha256.New),
+			dupfind.WithReferenceRoots(archive),
+			dupfind.WithRoots(incoming),
+		)
+		unique, err := dupFinder.FindUnique(ctx)
+		assert.NoError(t, err)
+		assert.Equal(t, []string{
+			"incoming/b",
+			"incoming/c",
+			"incoming/c2",
+			"incoming/d",
+		}, uniquePaths(unique))
+		assert.Equal(t, 1, unique[0].Size)
+
+		// Files with unique sizes are not opened.
+		assert.Equal(t, 6, dupFinder.Statistics().FilesOpened)
+	})
+
+	t.Run("roots", func(t *testing.T) {
+		dupFinder := dupfind.NewDupFinder(
+			dupfind.WithHashFunc(sha256.New),
+			dupfind.WithRoots(archive, incoming),
+		)
+		unique, err := dupFinder.FindUnique(ctx)
+		assert.NoError(t, err)
+		assert.Equal(t, []string{
+			"archive/e",
+			"archive/x",
+			"incoming/b",
+			"incoming/c",
+			"incoming/c2",
+			"incoming/d",
+		}, uniquePaths(unique))
+	})
+
+	t.Run("root", func(t *testing.T) {
+		dupFinder := dupfind.NewDupFinder(
+			dupfind.WithHashFunc(sha256.New),
+			dupfind.WithRoots(incoming),
+		)
+		unique, err := dupFinder.FindUnique(ctx)
+		assert.NoError(t, err)
+		assert.Equal(t, []string{
+			"incoming/a",
+			"incoming/b",
+			"incoming/d",
+		}, uniquePaths(unique))
+	})
+}
+
+func TestDupFinderGroupFunc(t *testing.T) {
+	ctx := t.Context()
+
+	fs, cleanup, err := vfst.NewTestFS(map[string]any{
+		"alpha": "a",
+		"beta":  "a",
+		"gamma": "bb",
+		"delta": "bb",
+	})
+	assert.NoError(t, err)
+	defer cleanup()
+
+	// Block hashing the larger files until the group of smaller files has
+	// been reported, to check that groups are reported as soon as they are
+	// final.
+	smallGroupReported := make(chan struct{})
+	newHash := func() hash.Hash {
+		return &blockingHash{
+			Hash:      sha256.New(),
+			blockSize: 2,
+			unblockCh: smallGroupReported,
+		}
+	}
+
+	type group struct {
+		hash  string
+		size  int64
+		paths []string
+	}
+	var groups []group
+	dupFinder := dupfind.NewDupFinder(
+		dupfind.WithGroupFunc(func(g *dupfind.Group) error {
+			groups = append(groups, group{
+				hash:  g.Hash,
+				size:  g.Size,
+				paths: trimPrefixes(g.Paths(), fs.TempDir()+"/"),
+			})
+			if g.Size == 1 {
+				close(smallGroupReported)
+			}
+			return nil
+		}),
+		dupfind.WithHashFunc(newHash),
+		dupfind.WithRoots(fs.TempDir()),
+	)
+	_, err = dupFinder.FindDuplicates(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, []group{
+		{
+			hash:  "ca978112ca1bbdcafac231b39a23dc4da786eff8147c4e72b9807785afee48bb",
+			size:  1,
+			paths: []string{"alpha", "beta"},
+		},
+		{
+			hash:  "3b64db95cb55c763391c707108489ae18b4112d783300de38e033b4c98c3deaf",
+			size:  2,
+			paths: []string{"delta", "gamma"},
+		},
+	}, groups)
+}
+
+func TestDupFinderDirectories(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		root func(string) string
+	}{
+		{
+			name: "absolute",
+			root: func(tempDir string) string {
+				return tempDir
+			},
+		},
+		{
+			name: "dot",
+			root: func(string) string {
+				return "."
+			},
+		},
+		{
+			name: "dot_slash",
+			root: func(string) string {
+				return "./"
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := t.Context()
+
+			subdirectory := map[string]any{
+				"x": "xx",
+				"y": "yyy",
+				"sub": map[string]any{
+					"z":    "zzzz",
+					"link": &vfst.Symlink{Target: "z"},
+				},
+			}
+			fs, cleanup, err := vfst.NewTestFS(map[string]any{
+				"backup": map[string]any{
+					"a": subdirectory,
+				},
+				"copy": map[string]any{
+					"a": subdirectory,
+				},
+				"other": map[string]any{
+					"x": "xx",
+					"q": "q",
+				},
+				"third": map[string]any{
+					"sub": map[string]any{
+						"z":    "zzzz",
+						"link": &vfst.Symlink{Target: "z"},
+					},
+					"fourth": map[string]any{
+						"z":    "zzzz",
+						"link": &vfst.Symlink{Target: "other"},
+					},
+				},
+				"empty1": &vfst.Dir{Perm: 0o777},
+				"empty2": &vfst.Dir{Perm: 0o777},
+			})
+			assert.NoError(t, err)
+			defer cleanup()
+			t.Chdir(fs.TempDir())
+
+			dupFinder := dupfind.NewDupFinder(
+				dupfind.WithDirectories(true),
+				dupfind.WithHashFunc(sha256.New),
+				dupfind.WithRoots(tc.root(fs.TempDir())),
+				dupfind.WithThreshold(2),
+			)
+			result, err := dupFinder.Find(ctx)
+			assert.NoError(t, err)
+			var actual [][]string
+			for _, paths := range relValuePaths(t, result.Map(), fs.TempDir()) {
+				actual = append(actual, paths)
 			}
+			slices.SortFunc(actual, slices.Compare)
+			assert.Equal(t, [][]string{
+				{"backup", "copy"},
+				{"backup/a/sub", "copy/a/sub", "third/sub"},
+			}, actual)
+			for _, group := range result.Groups {
+				assert.Equal(t, int64(len(group.Files)-1)*group.Size, group.WastedBytes)
+			}
+		})
+	}
+}
+
+func TestDupFinderDirectoriesParentsInDifferentGroups(t *testing.T) {
+	ctx := t.Context()
+
+	d := map[string]any{
+		"a": "aaaa",
+	}
+	fs, cleanup, err := vfst.NewTestFS(map[string]any{
+		"p1": map[string]any{
+			"d": d,
+			"x": "x",
+		},
+		"p2": map[string]any{
+			"d": d,
+			"y": "yy",
+		},
+		"p3": map[string]any{
+			"d": d,
+			"x": "x",
+		},
+		"p4": map[string]any{
+			"d": d,
+			"y": "yy",
+		},
+	})
+	assert.NoError(t, err)
+	defer cleanup()
+
+	dupFinder := dupfind.NewDupFinder(
+		dupfind.WithDirectories(true),
+		dupfind.WithHashFunc(sha256.New),
+		dupfind.WithRoots(fs.TempDir()),
+	)
+	result, err := dupFinder.Find(ctx)
+	assert.NoError(t, err)
+	var actual [][]string
+	for _, group := range result.Groups {
+		actual = append(actual, trimPrefixes(group.Paths(), fs.TempDir()+"/"))
+	}
+	slices.SortFunc(actual, slices.Compare)
+	assert.Equal(t, [][]string{
+		{"p1", "p3"},
+		{"p1/d", "p2/d", "p3/d", "p4/d"},
+		{"p2", "p4"},
+	}, actual)
+}
+
+func TestDupFinderFind(t *testing.T) {
+	ctx := t.Context()
+
+	fs, cleanup, err := vfst.NewTestFS(map[string]any{
+		"root1": map[string]any{
+			"alpha": &vfst.File{
+				Perm:     0o600,
+				Contents: []byte("a"),
+			},
+			"beta": "bbbb",
+		},
+		"root2": map[string]any{
+			"gamma": "a",
+			"delta": "a",
+			"epsilon": &vfst.File{
+				Perm:     0o644,
+				Contents: []byte("bbbb"),
+			},
+		},
+	})
+	assert.NoError(t, err)
+	defer cleanup()
+
+	root1 := filepath.Join(fs.TempDir(), "root1")
+	root2 := filepath.Join(fs.TempDir(), "root2")
+	dupFinder := dupfind.NewDupFinder(
+		dupfind.WithHashFunc(newConstantHash),
+		dupfind.WithRoots(root1, root2),
+		dupfind.WithVerify(true),
+	)
+	result, err := dupFinder.Find(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, 2+4, result.WastedBytes)
+
+	result.SortByWastedBytes()
+	assert.Equal(t, 2, len(result.Groups))
+	assert.Equal(t, 4, result.Groups[0].Size)
+	assert.Equal(t, 4, result.Groups[0].WastedBytes)
+	assert.Equal(t, 1, result.Groups[1].Size)
+	assert.Equal(t, 2, result.Groups[1].WastedBytes)
+	assert.Equal(t, []string{
+		filepath.Join(root1, "alpha"),
+		filepath.Join(root2, "delta"),
+		filepath.Join(root2, "gamma"),
+	}, result.Groups[1].Paths())
+
+	alpha := result.Groups[1].Files[0]
+	assert.Equal(t, root1, alpha.Root)
+	assert.Equal(t, os.FileMode(0o600), alpha.Mode.Perm())
+	fileInfo, err := os.Stat(alpha.Path)
+	assert.NoError(t, err)
+	assert.True(t, fileInfo.ModTime().Equal(alpha.ModTime))
+	assert.NotZero(t, alpha.Ino)
+	assert.Equal(t, root2, result.Groups[0].Files[1].Root)
+
+	// Both groups have the same hash, so one of them has a suffix.
+	keys := slices.Sorted(maps.Keys(result.Map()))
+	assert.Equal(t, []string{"00", "00-1"}, keys)
+}
+
+func TestDupFinderVerifyConcurrency(t *testing.T) {
+	ctx, cancel := context.WithTimeout(t.Context(), 10*time.Second)
+	defer cancel()
+
+	fs, cleanup, err := vfst.NewTestFS(map[string]any{
+		"alpha": "a",
+		"beta":  "a",
+		"gamma": "b",
+	})
+	assert.NoError(t, err)
+	defer cleanup()
+
+	// Verifying opens two files at once, which must not deadlock when only
+	// one file may be open or hashed at a time.
+	dupFinder := dupfind.NewDupFinder(
+		dupfind.WithDeviceConcurrency(func(uint64, bool) int {
+			return 1
+		}),
+		dupfind.WithHashConcurrency(1),
+		dupfind.WithHashFunc(newConstantHash),
+		dupfind.WithRoots(fs.TempDir()),
+		dupfind.WithVerify(true),
+	)
+	result, err := dupFinder.Find(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(result.Groups))
+	assert.Equal(t, []string{"alpha", "beta"}, trimPrefixes(result.Groups[0].Paths(), fs.TempDir()+"/"))
+}
+
+func TestDupFinderHashConcurrency(t *testing.T) {
+	root := make(map[string]any)
+	for i := range 32 {
+		root["file"+strconv.Itoa(i)] = "contents"
+	}
+	fs, cleanup, err := vfst.NewTestFS(root)
+	assert.NoError(t, err)
+	defer cleanup()
+
+	for _, tc := range []struct {
+		name     string
+		options  []dupfind.Option
+		expected int
+	}{
+		{
+			name: "hash_concurrency",
+			options: []dupfind.Option{
+				dupfind.WithHashConcurrency(2),
+			},
+			expected: 2,
+		},
+		{
+			name: "device_concurrency",
+			options: []dupfind.Option{
+				dupfind.WithDeviceConcurrency(func(uint64, bool) int {
+					return 1
+				}),
+				dupfind.WithHashConcurrency(8),
+			},
+			expected: 1,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			concurrency := &concurrency{}
+			options := slices.Clone(tc.options)
+			options = append(options,
+				dupfind.WithBlockSize(2),
+				dupfind.WithHashFunc(func() hash.Hash {
+					return &concurrencyHash{
+						Hash:        sha256.New(),
+						concurrency: concurrency,
+					}
+				}),
+				dupfind.WithRoots(fs.TempDir()),
+			)
+			dupFinder := dupfind.NewDupFinder(options...)
+			actual, err := dupFinder.FindDuplicates(t.Context())
+			assert.NoError(t, err)
+			assert.Equal(t, 1, len(actual))
+			assert.True(t, concurrency.max.Load() <= int64(tc.expected))
 		})
 	}
 }
 
+func TestDupFinderHashCache(t *testing.T) {
+	ctx := t.Context()
+
+	fs, cleanup, err := vfst.NewTestFS(map[string]any{
+		"alpha": "a",
+		"beta":  "a",
+		"gamma": "b",
+	})
+	assert.NoError(t, err)
+	defer cleanup()
+
+	hashCache := newMapHashCache()
+	expected := map[string][]string{
+		"ca978112ca1bbdcafac231b39a23dc4da786eff8147c4e72b9807785afee48bb": {
+			"alpha",
+			"beta",
+		},
+	}
+
+	for i, expectedStatistics := range []*dupfind.Statistics{
+		{
+			DirEntries:         4,
+			Files:              3,
+			FilesOpened:        3,
+			FilesOpenedPercent: 100,
+			TotalBytes:         3,
+			BytesHashed:        3,
+			BytesHashedPercent: 100,
+			UniqueSizes:        1,
+			CacheMisses:        3,
+			Head: dupfind.StageStatistics{
+				FilesHashed:     3,
+				BytesHashed:     3,
+				FilesEliminated: 1,
+			},
+		},
+		{
+			DirEntries:  4,
+			Files:       3,
+			TotalBytes:  3,
+			UniqueSizes: 1,
+			CacheHits:   3,
+			Head: dupfind.StageStatistics{
+				FilesEliminated: 1,
+			},
+		},
+	} {
+		dupFinder := dupfind.NewDupFinder(
+			dupfind.WithHashCache(hashCache, "sha256"),
+			dupfind.WithHashFunc(sha256.New),
+			dupfind.WithRoots(fs.TempDir()),
+		)
+		actual, err := dupFinder.FindDuplicates(ctx)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, trimValuePrefixes(actual, fs.TempDir()+"/"), "run %d", i)
+		assert.Equal(t, expectedStatistics, countStatistics(dupFinder), "run %d", i)
+	}
+}
+
+func TestDupFinderHardlinks(t *testing.T) {
+	for _, tc := range []struct {
+		name                string
+		hardlinkMode        dupfind.HardlinkMode
+		expected            map[string][]string
+		expectedHardlinks   [][]string
+		expectedFilesHashed uint64
+	}{
+		{
+			name:         "duplicates",
+			hardlinkMode: dupfind.HardlinkModeDuplicates,
+			expected: map[string][]string{
+				"3e23e8160039594a33894f6564e1b1348bbd7a0088d42c4acb73eeaed59c009d": {
+					"delta",
+					"epsilon",
+				},
+				"ca978112ca1bbdcafac231b39a23dc4da786eff8147c4e72b9807785afee48bb": {
+					"alpha",
+					"beta",
+					"gamma",
+				},
+			},
+			expectedFilesHashed: 3,
+		},
+		{
+			name:         "group",
+			hardlinkMode: dupfind.HardlinkModeGroup,
+			expected: map[string][]string{
+				"ca978112ca1bbdcafac231b39a23dc4da786eff8147c4e72b9807785afee48bb": {
+					"alpha",
+					"gamma",
+				},
+			},
+			expectedHardlinks: [][]string{
+				{"alpha", "beta"},
+				{"delta", "epsilon"},
+			},
+			expectedFilesHashed: 3,
+		},
+		{
+			name:         "hide",
+			hardlinkMode: dupfind.HardlinkModeHide,
+			expected: map[string][]string{
+				"ca978112ca1bbdcafac231b39a23dc4da786eff8147c4e72b9807785afee48bb": {
+					"alpha",
+					"gamma",
+				},
+			},
+			expectedFilesHashed: 3,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := t.Context()
+
+			fs, cleanup, err := vfst.NewTestFS(map[string]any{
+				"alpha": "a",
+				"gamma": "a",
+				"delta": "b",
+			})
+			assert.NoError(t, err)
+			defer cleanup()
+			assert.NoError(t, os.Link(filepath.Join(fs.TempDir(), "alpha"), filepath.Join(fs.TempDir(), "beta")))
+			assert.NoError(t, os.Link(filepath.Join(fs.TempDir(), "delta"), filepath.Join(fs.TempDir(), "epsilon")))
+
+			dupFinder := dupfind.NewDupFinder(
+				dupfind.WithHardlinkMode(tc.hardlinkMode),
+				dupfind.WithHashFunc(sha256.New),
+				dupfind.WithRoots(fs.TempDir()),
+			)
+			actual, err := dupFinder.FindDuplicates(ctx)
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expected, trimValuePrefixes(actual, fs.TempDir()+"/"))
+			var actualHardlinks [][]string
+			for _, paths := range dupFinder.Hardlinks() {
+				actualHardlinks = append(actualHardlinks, trimPrefixes(paths, fs.TempDir()+"/"))
+			}
+			assert.Equal(t, tc.expectedHardlinks, actualHardlinks)
+			statistics := dupFinder.Statistics()
+			assert.Equal(t, 2, statistics.Hardlinks)
+			assert.Equal(t, tc.expectedFilesHashed, statistics.Head.FilesHashed)
+		})
+	}
+}
+
+func TestDupFinderOverlappingRoots(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		roots func(string) []string
+	}{
+		{
+			name: "dot",
+			roots: func(string) []string {
+				return []string{".", "archive"}
+			},
+		},
+		{
+			name: "dot_slash",
+			roots: func(string) []string {
+				return []string{"./", "./archive/"}
+			},
+		},
+		{
+			name: "absolute_and_relative",
+			roots: func(tempDir string) []string {
+				return []string{tempDir, "archive"}
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := t.Context()
+
+			fs, cleanup, err := vfst.NewTestFS(map[string]any{
+				"alpha": "a",
+				"archive": map[string]any{
+					"beta":  "a",
+					"delta": "b",
+					"gamma": "c",
+				},
+			})
+			assert.NoError(t, err)
+			defer cleanup()
+			assert.NoError(t, os.Link(filepath.Join(fs.TempDir(), "archive", "gamma"), filepath.Join(fs.TempDir(), "archive", "epsilon")))
+			t.Chdir(fs.TempDir())
+
+			dupFinder := dupfind.NewDupFinder(
+				dupfind.WithHashFunc(sha256.New),
+				dupfind.WithRoots(tc.roots(fs.TempDir())...),
+			)
+			actual, err := dupFinder.FindDuplicates(ctx)
+			assert.NoError(t, err)
+			for key, paths := range actual {
+				for i, path := range paths {
+					if !filepath.IsAbs(path) {
+						path = filepath.Join(fs.TempDir(), path)
+					}
+					relPath, err := filepath.Rel(fs.TempDir(), path)
+					assert.NoError(t, err)
+					paths[i] = relPath
+				}
+				slices.Sort(paths)
+				actual[key] = paths
+			}
+			assert.Equal(t, map[string][]string{
+				"2e7d2c03a9507ae265ecf5b5356885a53393a2029d241394997265a1a25aefc6": {
+					"archive/epsilon",
+					"archive/gamma",
+				},
+				"ca978112ca1bbdcafac231b39a23dc4da786eff8147c4e72b9807785afee48bb": {
+					"alpha",
+					"archive/beta",
+				},
+			}, actual)
+		})
+	}
+}
+
+func TestDupFinderFilter(t *testing.T) {
+	ctx := t.Context()
+
+	fs, cleanup, err := vfst.NewTestFS(map[string]any{
+		"a.jpg": "a",
+		"b.JPG": "a",
+		"c.txt": "a",
+		"photos": map[string]any{
+			"d.jpg": "a",
+			"thumbnails": map[string]any{
+				"e.jpg": "a",
+			},
+		},
+	})
+	assert.NoError(t, err)
+	defer cleanup()
+
+	dupFinder := dupfind.NewDupFinder(
+		dupfind.WithFilter(mustNewFilter(t,
+			filter.Rule{Action: filter.Include, Pattern: "*.jpg", IgnoreCase: true},
+			filter.Rule{Action: filter.Exclude, Pattern: "thumbnails"},
+		)),
+		dupfind.WithHashFunc(sha256.New),
+		dupfind.WithRoots(fs.TempDir()),
+	)
+	actual, err := dupFinder.FindDuplicates(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string][]string{
+		"ca978112ca1bbdcafac231b39a23dc4da786eff8147c4e72b9807785afee48bb": {
+			"a.jpg",
+			"b.JPG",
+			"photos/d.jpg",
+		},
+	}, trimValuePrefixes(actual, fs.TempDir()+"/"))
+}
+
+func TestDupFinderFilterAbsolutePattern(t *testing.T) {
+	ctx := t.Context()
+
+	fs, cleanup, err := vfst.NewTestFS(map[string]any{
+		"alpha": "a",
+		"beta":  "a",
+		"excluded": map[string]any{
+			"gamma": "a",
+		},
+	})
+	assert.NoError(t, err)
+	defer cleanup()
+	t.Chdir(fs.TempDir())
+
+	// An absolute pattern matches even when the root is relative.
+	dupFinder := dupfind.NewDupFinder(
+		dupfind.WithFilter(mustNewFilter(t,
+			filter.Rule{Action: filter.Exclude, Pattern: filepath.ToSlash(filepath.Join(fs.TempDir(), "excluded")) + "/**"},
+		)),
+		dupfind.WithHashFunc(sha256.New),
+		dupfind.WithRoots("."),
+	)
+	actual, err := dupFinder.FindDuplicates(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string][]string{
+		"ca978112ca1bbdcafac231b39a23dc4da786eff8147c4e72b9807785afee48bb": {
+			"alpha",
+			"beta",
+		},
+	}, trimValuePrefixes(actual, "./"))
+}
+
+func TestDupFinderIgnoreFiles(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		root func(string) string
+	}{
+		{
+			name: "absolute",
+			root: func(tempDir string) string {
+				return tempDir
+			},
+		},
+		{
+			name: "dot",
+			root: func(string) string {
+				return "."
+			},
+		},
+		{
+			name: "dot_slash",
+			root: func(string) string {
+				return "./"
+			},
+		},
+		{
+			name: "trailing_slash",
+			root: func(tempDir string) string {
+				t.Chdir(filepath.Dir(tempDir))
+				return filepath.Base(tempDir) + "/"
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := t.Context()
+
+			fs, cleanup, err := vfst.NewTestFS(map[string]any{
+				".dupignore": "*.tmp\n",
+				".gitignore": "node_modules/\n/target\n*.o\n!keep.o\n",
+				"a":          "a",
+				"a.o":        "a",
+				"a.tmp":      "a",
+				"keep.o":     "a",
+				"node_modules": map[string]any{
+					"a": "a",
+				},
+				"src": map[string]any{
+					".gitignore": "!*.o\n",
+					"a.o":        "a",
+					"sub": map[string]any{
+						".gitignore": "*.c\n",
+						"a":          "a",
+						"a.c":        "a",
+						"a.o":        "a",
+					},
+					"target": "a",
+				},
+				"target": map[string]any{
+					"a": "a",
+				},
+			})
+			assert.NoError(t, err)
+			defer cleanup()
+			t.Chdir(fs.TempDir())
+
+			dupFinder := dupfind.NewDupFinder(
+				dupfind.WithHashFunc(sha256.New),
+				dupfind.WithIgnoreFiles(".gitignore", ".dupignore"),
+				dupfind.WithRoots(tc.root(fs.TempDir())),
+			)
+			actual, err := dupFinder.FindDuplicates(ctx)
+			assert.NoError(t, err)
+			assert.Equal(t, map[string][]string{
+				"ca978112ca1bbdcafac231b39a23dc4da786eff8147c4e72b9807785afee48bb": {
+					"a",
+					"keep.o",
+					"src/a.o",
+					"src/sub/a",
+					"src/sub/a.o",
+					"src/target",
+				},
+			}, relValuePaths(t, actual, fs.TempDir()))
+		})
+	}
+}
+
+func TestDupFinderLimits(t *testing.T) {
+	oldModTime := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	for _, tc := range []struct {
+		name     string
+		options  []dupfind.Option
+		expected map[string][]string
+	}{
+		{
+			name: "min_size",
+			options: []dupfind.Option{
+				dupfind.WithMinSize(1),
+			},
+			expected: map[string][]string{
+				"61be55a8e2f6b4e172338bddf184d6dbee29c98853e0a0485ecee7f27b9af0b4": {
+					"large1",
+					"large2",
+				},
+				"3b64db95cb55c763391c707108489ae18b4112d783300de38e033b4c98c3deaf": {
+					"old1",
+					"old2",
+				},
+				"ca978112ca1bbdcafac231b39a23dc4da786eff8147c4e72b9807785afee48bb": {
+					"small1",
+					"small2",
+				},
+			},
+		},
+		{
+			name: "max_size",
+			options: []dupfind.Option{
+				dupfind.WithMaxSize(1),
+			},
+			expected: map[string][]string{
+				"e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855": {
+					"empty1",
+					"empty2",
+				},
+				"ca978112ca1bbdcafac231b39a23dc4da786eff8147c4e72b9807785afee48bb": {
+					"small1",
+					"small2",
+				},
+			},
+		},
+		{
+			name: "min_and_max_size",
+			options: []dupfind.Option{
+				dupfind.WithMinSize(2),
+				dupfind.WithMaxSize(2),
+			},
+			expected: map[string][]string{
+				"3b64db95cb55c763391c707108489ae18b4112d783300de38e033b4c98c3deaf": {
+					"old1",
+					"old2",
+				},
+			},
+		},
+		{
+			name: "modified_since",
+			options: []dupfind.Option{
+				dupfind.WithModifiedSince(oldModTime.Add(time.Second)),
+			},
+			expected: map[string][]string{
+				"e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855": {
+					"empty1",
+					"empty2",
+				},
+				"61be55a8e2f6b4e172338bddf184d6dbee29c98853e0a0485ecee7f27b9af0b4": {
+					"large1",
+					"large2",
+				},
+				"ca978112ca1bbdcafac231b39a23dc4da786eff8147c4e72b9807785afee48bb": {
+					"small1",
+					"small2",
+				},
+			},
+		},
+		{
+			name: "modified_before",
+			options: []dupfind.Option{
+				dupfind.WithModifiedBefore(oldModTime.Add(time.Second)),
+			},
+			expected: map[string][]string{
+				"3b64db95cb55c763391c707108489ae18b4112d783300de38e033b4c98c3deaf": {
+					"old1",
+					"old2",
+				},
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := t.Context()
+
+			fs, cleanup, err := vfst.NewTestFS(map[string]any{
+				"empty1": "",
+				"empty2": "",
+				"large1": "aaaa",
+				"large2": "aaaa",
+				"old1":   "bb",
+				"old2":   "bb",
+				"small1": "a",
+				"small2": "a",
+			})
+			assert.NoError(t, err)
+			defer cleanup()
+			for _, name := range []string{"old1", "old2"} {
+				assert.NoError(t, os.Chtimes(filepath.Join(fs.TempDir(), name), oldModTime, oldModTime))
+			}
+
+			dupFinder := dupfind.NewDupFinder(slices.Concat([]dupfind.Option{
+				dupfind.WithHashFunc(sha256.New),
+				dupfind.WithRoots(fs.TempDir()),
+			}, tc.options)...)
+			actual, err := dupFinder.FindDuplicates(ctx)
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expected, trimValuePrefixes(actual, fs.TempDir()+"/"))
+			assert.Equal(t, uint64(2*len(tc.expected)), dupFinder.Statistics().Files)
+		})
+	}
+}
+
+func TestDupFinderSymlinks(t *testing.T) {
+	for _, tc := range []struct {
+		name             string
+		options          []dupfind.Option
+		expected         map[string][]string
+		expectedSymlinks []string
+	}{
+		{
+			name: "default",
+			expected: map[string][]string{
+				"ca978112ca1bbdcafac231b39a23dc4da786eff8147c4e72b9807785afee48bb": {
+					"alpha",
+					"beta",
+					"dir/gamma",
+				},
+			},
+		},
+		{
+			name: "one_file_system",
+			options: []dupfind.Option{
+				dupfind.WithOneFileSystem(true),
+			},
+			expected: map[string][]string{
+				"ca978112ca1bbdcafac231b39a23dc4da786eff8147c4e72b9807785afee48bb": {
+					"alpha",
+					"beta",
+					"dir/gamma",
+				},
+			},
+		},
+		{
+			name: "report_symlinks",
+			options: []dupfind.Option{
+				dupfind.WithReportSymlinks(true),
+			},
+			expected: map[string][]string{
+				"ca978112ca1bbdcafac231b39a23dc4da786eff8147c4e72b9807785afee48bb": {
+					"alpha",
+					"beta",
+					"dir/gamma",
+				},
+			},
+			expectedSymlinks: []string{
+				"dir/link",
+				"link",
+			},
+		},
+		{
+			name: "follow_symlinks",
+			options: []dupfind.Option{
+				dupfind.WithFollowSymlinks(true),
+			},
+			expected: map[string][]string{
+				"ca978112ca1bbdcafac231b39a23dc4da786eff8147c4e72b9807785afee48bb": {
+					"alpha",
+					"beta",
+					"dir/gamma",
+					"dir/link",
+					"link",
+					"outside/delta",
+				},
+			},
+		},
+		{
+			name: "follow_symlinks_hide_hardlinks",
+			options: []dupfind.Option{
+				dupfind.WithFollowSymlinks(true),
+				dupfind.WithHardlinkMode(dupfind.HardlinkModeHide),
+			},
+			expected: map[string][]string{
+				"ca978112ca1bbdcafac231b39a23dc4da786eff8147c4e72b9807785afee48bb": {
+					"alpha",
+					"beta",
+					"dir/gamma",
+					"outside/delta",
+				},
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := t.Context()
+
+			fs, cleanup, err := vfst.NewTestFS(map[string]any{
+				"root": map[string]any{
+					"alpha": "a",
+					"beta":  "a",
+					"dir": map[string]any{
+						"gamma": "a",
+						"link":  &vfst.Symlink{Target: "../beta"},
+						"loop":  &vfst.Symlink{Target: ".."},
+					},
+					"broken":  &vfst.Symlink{Target: "missing"},
+					"link":    &vfst.Symlink{Target: "alpha"},
+					"outside": &vfst.Symlink{Target: "../outside"},
+				},
+				"outside": map[string]any{
+					"delta": "a",
+					"loop":  &vfst.Symlink{Target: "../root/dir"},
+				},
+			})
+			assert.NoError(t, err)
+			defer cleanup()
+			root := filepath.Join(fs.TempDir(), "root")
+
+			dupFinder := dupfind.NewDupFinder(slices.Concat([]dupfind.Option{
+				dupfind.WithHashFunc(sha256.New),
+				dupfind.WithRoots(root),
+			}, tc.options)...)
+			result, err := dupFinder.Find(ctx)
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expected, trimValuePrefixes(result.Map(), root+"/"))
+			var actualSymlinks []string
+			for _, group := range result.Groups {
+				actualSymlinks = append(actualSymlinks, trimPrefixes(group.Symlinks, root+"/")...)
+			}
+			assert.Equal(t, tc.expectedSymlinks, actualSymlinks)
+			assert.Equal(t, 0, dupFinder.Statistics().Errors)
+		})
+	}
+}
+
+func TestDupFinderArchives(t *testing.T) {
+	large := strings.Repeat("0123456789", 1000)
+	largeHash := sha256.Sum256([]byte(large))
+	for _, tc := range []struct {
+		name                string
+		options             []dupfind.Option
+		expected            map[string][]string
+		expectedFilesOpened uint64
+	}{
+		{
+			name:                "default",
+			expected:            map[string][]string{},
+			expectedFilesOpened: 2,
+		},
+		{
+			name: "depth_1",
+			options: []dupfind.Option{
+				dupfind.WithArchiveDepth(1),
+			},
+			expected: map[string][]string{
+				"2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae": {
+					"foo.so",
+					"release.tar.gz!/lib/foo.so",
+					"release.zip!/lib/foo.so",
+				},
+				"baa5a0964d3320fbc0c6a922140453c8513ea24ab8fd0577034804a967248096": {
+					"baz",
+					"release.tar.gz!/baz",
+				},
+				hex.EncodeToString(largeHash[:]): {
+					"large",
+					"release.tar.gz!/large",
+				},
+			},
+			expectedFilesOpened: 3,
+		},
+		{
+			name: "depth_2",
+			options: []dupfind.Option{
+				dupfind.WithArchiveDepth(2),
+			},
+			expected: map[string][]string{
+				"2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae": {
+					"foo.so",
+					"release.tar.gz!/lib/foo.so",
+					"release.zip!/lib/foo.so",
+				},
+				"baa5a0964d3320fbc0c6a922140453c8513ea24ab8fd0577034804a967248096": {
+					"baz",
+					"release.tar.gz!/baz",
+					"release.zip!/inner.tar!/baz",
+				},
+				"fcde2b2edba56bf408601fb721fe9b5c338d10ee429ea04fae5511b68fbf8fb9": {
+					"release.zip!/inner.tar!/bar",
+					"release.zip!/lib/bar",
+				},
+				hex.EncodeToString(largeHash[:]): {
+					"large",
+					"release.tar.gz!/large",
+				},
+			},
+			expectedFilesOpened: 3,
+		},
+		{
+			name: "exclude",
+			options: []dupfind.Option{
+				dupfind.WithArchiveDepth(2),
+				dupfind.WithFilter(mustNewFilter(t,
+					filter.Rule{Action: filter.Exclude, Type: filter.Glob, Pattern: "*.so"},
+					filter.Rule{Action: filter.Exclude, Type: filter.Glob, Pattern: "inner.tar"},
+				)),
+			},
+			expected: map[string][]string{
+				"baa5a0964d3320fbc0c6a922140453c8513ea24ab8fd0577034804a967248096": {
+					"baz",
+					"release.tar.gz!/baz",
+				},
+				hex.EncodeToString(largeHash[:]): {
+					"large",
+					"release.tar.gz!/large",
+				},
+			},
+			expectedFilesOpened: 2,
+		},
+		{
+			name: "verify",
+			options: []dupfind.Option{
+				dupfind.WithArchiveDepth(2),
+				dupfind.WithVerify(true),
+			},
+			expected: map[string][]string{
+				"2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae": {
+					"foo.so",
+					"release.tar.gz!/lib/foo.so",
+					"release.zip!/lib/foo.so",
+				},
+				"baa5a0964d3320fbc0c6a922140453c8513ea24ab8fd0577034804a967248096": {
+					"baz",
+					"release.tar.gz!/baz",
+					"release.zip!/inner.tar!/baz",
+				},
+				"fcde2b2edba56bf408601fb721fe9b5c338d10ee429ea04fae5511b68fbf8fb9": {
+					"release.zip!/inner.tar!/bar",
+					"release.zip!/lib/bar",
+				},
+				hex.EncodeToString(largeHash[:]): {
+					"large",
+					"release.tar.gz!/large",
+				},
+			},
+			expectedFilesOpened: 3,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := t.Context()
+
+			fs, cleanup, err := vfst.NewTestFS(map[string]any{
+				"baz":    "baz",
+				"foo.so": "foo",
+				"large":  large,
+				"release.tar.gz": newTarArchive(t, true, map[string]string{
+					"baz":        "baz",
+					"large":      large,
+					"lib/foo.so": "foo",
+				}),
+				"release.zip": newZipArchive(t, map[string]string{
+					"inner.tar": newTarArchive(t, false, map[string]string{
+						"bar": "bar",
+						"baz": "baz",
+					}),
+					"lib/bar":    "bar",
+					"lib/foo.so": "foo",
+				}),
+			})
+			assert.NoError(t, err)
+			defer cleanup()
+
+			dupFinder := dupfind.NewDupFinder(slices.Concat([]dupfind.Option{
+				dupfind.WithBlockSize(1024),
+				dupfind.WithHashFunc(sha256.New),
+				dupfind.WithRoots(fs.TempDir()),
+			}, tc.options)...)
+			result, err := dupFinder.Find(ctx)
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expected, trimValuePrefixes(result.Map(), fs.TempDir()+"/"))
+			// Archive members are hashed when the archives are scanned, so
+			// only regular files are opened.
+			assert.Equal(t, tc.expectedFilesOpened, dupFinder.Statistics().FilesOpened)
+			for _, group := range result.Groups {
+				for _, file := range group.Files {
+					var container string
+					if i := strings.LastIndex(file.Path, "!/"); i != -1 {
+						container = file.Path[:i]
+					}
+					assert.Equal(t, container, file.Container)
+				}
+			}
+		})
+	}
+}
+
+func TestDupFinderErrors(t *testing.T) {
+	root := make(map[string]any)
+	for i := range 256 {
+		root["dir"+strconv.Itoa(i%8)+"/file"+strconv.Itoa(i)] = "contents"
+	}
+	fs, cleanup, err := vfst.NewTestFS(root)
+	assert.NoError(t, err)
+	defer cleanup()
+
+	t.Run("keep_going", func(t *testing.T) {
+		numGoroutines := runtime.NumGoroutine()
+		var handledErrors atomic.Int64
+		dupFinder := dupfind.NewDupFinder(
+			dupfind.WithChannelBufferCapacity(0),
+			dupfind.WithErrorHandler(func(err error) error {
+				assert.IsError(t, err, errWrite)
+				handledErrors.Add(1)
+				return nil
+			}),
+			dupfind.WithHashConcurrency(16),
+			dupfind.WithHashFunc(newErrorHash),
+			dupfind.WithRoots(fs.TempDir()),
+		)
+		actual, err := dupFinder.FindDuplicates(t.Context())
+		assert.NoError(t, err)
+		assert.Equal(t, map[string][]string{}, actual)
+		assert.Equal(t, 256, handledErrors.Load())
+		assert.Equal(t, 256, dupFinder.Statistics().Errors)
+		pathErrors := dupFinder.Errors()
+		assert.Equal(t, 256, len(pathErrors))
+		assert.True(t, slices.IsSortedFunc(pathErrors, func(a, b *dupfind.PathError) int {
+			return strings.Compare(a.Path, b.Path)
+		}))
+		for _, pathError := range pathErrors {
+			assert.Equal(t, dupfind.ErrorStageRead, pathError.Stage)
+			assert.IsError(t, pathError, errWrite)
+		}
+		data, err := json.Marshal(pathErrors[0])
+		assert.NoError(t, err)
+		assert.Equal(t, `{"path":"`+pathErrors[0].Path+`","stage":"read","error":"write"}`, string(data))
+		assertNoGoroutineLeaks(t, numGoroutines)
+	})
+
+	t.Run("stop", func(t *testing.T) {
+		numGoroutines := runtime.NumGoroutine()
+		dupFinder := dupfind.NewDupFinder(
+			dupfind.WithChannelBufferCapacity(0),
+			dupfind.WithHashConcurrency(16),
+			dupfind.WithHashFunc(newErrorHash),
+			dupfind.WithRoots(fs.TempDir()),
+		)
+		_, err := dupFinder.FindDuplicates(t.Context())
+		assert.IsError(t, err, errWrite)
+		assertNoGoroutineLeaks(t, numGoroutines)
+	})
+
+	t.Run("cancel", func(t *testing.T) {
+		numGoroutines := runtime.NumGoroutine()
+		ctx, cancel := context.WithCancel(t.Context())
+		dupFinder := dupfind.NewDupFinder(
+			dupfind.WithHashFunc(func() hash.Hash {
+				return &blockingHash{
+					Hash:      sha256.New(),
+					blockSize: len("contents"),
+					unblockCh: ctx.Done(),
+				}
+			}),
+			dupfind.WithRoots(fs.TempDir()),
+		)
+		go func() {
+			time.Sleep(10 * time.Millisecond)
+			cancel()
+		}()
+		_, err := dupFinder.FindDuplicates(ctx)
+		assert.IsError(t, err, context.Canceled)
+		assertNoGoroutineLeaks(t, numGoroutines)
+	})
+}
+
+func TestDupFinderMetrics(t *testing.T) {
+	fs, cleanup, err := vfst.NewTestFS(map[string]any{
+		"alpha": "contents",
+		"beta":  "contents",
+		"gamma": "other contents",
+	})
+	assert.NoError(t, err)
+	defer cleanup()
+
+	var queues []dupfind.Queue
+	var dupFinder *dupfind.DupFinder
+	dupFinder = dupfind.NewDupFinder(
+		dupfind.WithGroupFunc(func(*dupfind.Group) error {
+			queues = dupFinder.Metrics().Queues
+			return nil
+		}),
+		dupfind.WithHashFunc(sha256.New),
+		dupfind.WithRoots(fs.TempDir()),
+	)
+	_, err = dupFinder.FindDuplicates(t.Context())
+	assert.NoError(t, err)
+	assert.Equal(t, 8, len(queues))
+	assert.Equal(t, "regular_files", queues[0].Name)
+
+	metrics := dupFinder.Metrics()
+	assert.Zero(t, len(metrics.Queues))
+	assert.Equal(t, 3, len(metrics.HashLatency))
+	head := metrics.HashLatency[0]
+	assert.Equal(t, "head", head.Stage)
+	assert.Equal(t, metrics.Statistics.Head.FilesHashed, head.Count)
+	assert.Equal(t, head.Count, head.Buckets[len(head.Buckets)-1].Count)
+	assert.Equal(t, 0, metrics.HashLatency[2].Count)
+}
+
+func TestDupFinderPipelineStatistics(t *testing.T) {
+	fs, cleanup, err := vfst.NewTestFS(map[string]any{
+		"alpha": "contents",
+		"beta":  "contents",
+		"gamma": "other contents",
+	})
+	assert.NoError(t, err)
+	defer cleanup()
+
+	dupFinder := dupfind.NewDupFinder(
+		dupfind.WithHashFunc(sha256.New),
+		dupfind.WithRoots(fs.TempDir()),
+	)
+	_, err = dupFinder.FindDuplicates(t.Context())
+	assert.NoError(t, err)
+	statistics := dupFinder.Statistics()
+	stages := make(map[string]dupfind.PipelineStageStatistics)
+	for _, stage := range statistics.Pipeline {
+		assert.False(t, stage.End.Before(stage.Start))
+		stages[stage.Stage] = stage
+	}
+	assert.Equal(t, 10, len(stages))
+	assert.Equal(t, 1, stages["walk"].Items)
+	assert.NotZero(t, stages["walk"].BusySeconds)
+	assert.NotZero(t, stages["walk"].MaxQueueDepth)
+	assert.Equal(t, 3, stages["stat"].Items)
+	assert.Equal(t, 2, stages["head_hash"].Items)
+	assert.NotZero(t, stages["head_hash"].BytesPerSecond)
+	assert.Equal(t, 2, stages["tail_hash"].Items)
+	assert.Zero(t, stages["tail_hash"].BytesPerSecond)
+	assert.NotZero(t, statistics.BytesHashedPerSecond)
+}
+
+func TestDupFinderProgress(t *testing.T) {
+	fs, cleanup, err := vfst.NewTestFS(map[string]any{
+		"alpha": "contents",
+		"beta":  "contents",
+		"gamma": "other contents",
+	})
+	assert.NoError(t, err)
+	defer cleanup()
+
+	var progresses []*dupfind.Progress
+	dupFinder := dupfind.NewDupFinder(
+		dupfind.WithProgressFunc(time.Millisecond, func(progress *dupfind.Progress) {
+			progresses = append(progresses, progress)
+		}),
+		dupfind.WithHashFunc(sha256.New),
+		dupfind.WithRoots(fs.TempDir()),
+	)
+	_, err = dupFinder.FindDuplicates(t.Context())
+	assert.NoError(t, err)
+	assert.NotZero(t, len(progresses))
+	for _, progress := range progresses[:len(progresses)-1] {
+		assert.False(t, progress.Done)
+	}
+	progress := progresses[len(progresses)-1]
+	assert.True(t, progress.Done)
+	assert.Equal(t, 3, progress.FilesWalked)
+	assert.Equal(t, 2, progress.Candidates)
+	assert.Equal(t, uint64(2*len("contents")), progress.BytesQueued)
+	assert.Equal(t, uint64(2*len("contents")), progress.BytesHashed)
+}
+
+// errWrite is the error returned by errorHash.
+var errWrite = errors.New("write")
+
+// An errorHash is a hash whose writes always fail, simulating a file that
+// cannot be read.
+type errorHash struct {
+	hash.Hash
+}
+
+func newErrorHash() hash.Hash { return errorHash{Hash: sha256.New()} }
+
+func (errorHash) Write([]byte) (int, error) { return 0, errWrite }
+
+// A blockingHash is a hash that blocks writes of blockSize bytes until
+// unblockCh is closed.
+type blockingHash struct {
+	hash.Hash
+	blockSize int
+	unblockCh <-chan struct{}
+}
+
+func (h *blockingHash) Write(p []byte) (int, error) {
+	if len(p) == h.blockSize {
+		select {
+		case <-h.unblockCh:
+		case <-time.After(10 * time.Second):
+			return 0, errors.New("timeout")
+		}
+	}
+	return h.Hash.Write(p)
+}
+
+// A concurrency records the maximum number of concurrent calls.
+type concurrency struct {
+	current atomic.Int64
+	max     atomic.Int64
+}
+
+// A concurrencyHash is a hash that records the maximum number of concurrent
+// writes.
+type concurrencyHash struct {
+	hash.Hash
+	concurrency *concurrency
+}
+
+func (h *concurrencyHash) Write(p []byte) (int, error) {
+	current := h.concurrency.current.Add(1)
+	defer h.concurrency.current.Add(-1)
+	for {
+		maxConcurrency := h.concurrency.max.Load()
+		if current <= maxConcurrency || h.concurrency.max.CompareAndSwap(maxConcurrency, current) {
+			break
+		}
+	}
+	time.Sleep(time.Millisecond)
+	return h.Hash.Write(p)
+}
+
+// A constantHash is a hash that always has the same value, so every file
+// collides.
+type constantHash struct{}
+
+func newConstantHash() hash.Hash { return constantHash{} }
+
+func (constantHash) BlockSize() int              { return 1 }
+func (constantHash) Reset()                      {}
+func (constantHash) Size() int                   { return 1 }
+func (constantHash) Sum(b []byte) []byte         { return append(b, 0) }
+func (constantHash) Write(p []byte) (int, error) { return len(p), nil }
+
+// A mapHashCache is a [dupfind.HashCache] backed by a map.
+type mapHashCache struct {
+	mutex  sync.Mutex
+	hashes map[dupfind.HashCacheKey]string
+}
+
+func newMapHashCache() *mapHashCache {
+	return &mapHashCache{
+		hashes: make(map[dupfind.HashCacheKey]string),
+	}
+}
+
+func (c *mapHashCache) Get(key dupfind.HashCacheKey) (string, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	hash, ok := c.hashes[key]
+	return hash, ok
+}
+
+func (c *mapHashCache) Set(key dupfind.HashCacheKey, hash string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.hashes[key] = hash
+}
+
+// assertNoGoroutineLeaks asserts that the number of goroutines returns to
+// numGoroutines.
+func assertNoGoroutineLeaks(t *testing.T, numGoroutines int) {
+	t.Helper()
+	for range 100 {
+		if runtime.NumGoroutine() <= numGoroutines {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Errorf("leaked %d goroutines", runtime.NumGoroutine()-numGoroutines)
+}
+
+// countStatistics returns dupFinder's statistics without timings, which are
+// not deterministic.
+func countStatistics(dupFinder *dupfind.DupFinder) *dupfind.Statistics {
+	statistics := dupFinder.Statistics()
+	statistics.BytesHashedPerSecond = 0
+	statistics.Pipeline = nil
+	return statistics
+}
+
+func newTarArchive(t *testing.T, gzipped bool, files map[string]string) string {
+	t.Helper()
+	buffer := &bytes.Buffer{}
+	var w io.Writer = buffer
+	var gzipWriter *gzip.Writer
+	if gzipped {
+		gzipWriter = gzip.NewWriter(buffer)
+		w = gzipWriter
+	}
+	tarWriter := tar.NewWriter(w)
+	for _, name := range slices.Sorted(maps.Keys(files)) {
+		assert.NoError(t, tarWriter.WriteHeader(&tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     name,
+			Mode:     0o644,
+			Size:     int64(len(files[name])),
+		}))
+		_, err := tarWriter.Write([]byte(files[name]))
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, tarWriter.Close())
+	if gzipWriter != nil {
+		assert.NoError(t, gzipWriter.Close())
+	}
+	return buffer.String()
+}
+
+func newZipArchive(t *testing.T, files map[string]string) string {
+	t.Helper()
+	buffer := &bytes.Buffer{}
+	zipWriter := zip.NewWriter(buffer)
+	for _, name := range slices.Sorted(maps.Keys(files)) {
+		w, err := zipWriter.Create(name)
+		assert.NoError(t, err)
+		_, err = w.Write([]byte(files[name]))
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, zipWriter.Close())
+	return buffer.String()
+}
+
+func mustNewFilter(t *testing.T, rules ...filter.Rule) *filter.Filter {
+	t.Helper()
+	f, err := filter.New(rules...)
+	assert.NoError(t, err)
+	return f
+}
+
+// relValuePaths returns m with each path made relative to dir, sorted.
+// Relative paths are relative to the current directory.
+func relValuePaths(t *testing.T, m map[string][]string, dir string) map[string][]string {
+	t.Helper()
+	workingDir, err := os.Getwd()
+	assert.NoError(t, err)
+	result := make(map[string][]string, len(m))
+	for key, paths := range m {
+		relPaths := make([]string, 0, len(paths))
+		for _, path := range paths {
+			if !filepath.IsAbs(path) {
+				path = filepath.Join(workingDir, path)
+			}
+			relPath, err := filepath.Rel(dir, path)
+			assert.NoError(t, err)
+			relPaths = append(relPaths, filepath.ToSlash(relPath))
+		}
+		slices.Sort(relPaths)
+		result[key] = relPaths
+	}
+	return result
+}
+
 func trimValuePrefixes(m map[string][]string, prefix string) map[string][]string {
 	result := make(map[string][]string, len(m))
 	for key, value := range m {
@@ -0,0 +1,70 @@
+package dupfind
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"syscall"
+)
+
+// An ErrorStage is the stage at which a path could not be processed.
+type ErrorStage string
+
+// Error stages.
+const (
+	// ErrorStageWalk is when a directory could not be read.
+	ErrorStageWalk ErrorStage = "walk"
+	// ErrorStageStat is when a directory entry's metadata could not be read.
+	ErrorStageStat ErrorStage = "stat"
+	// ErrorStageOpen is when a file could not be opened.
+	ErrorStageOpen ErrorStage = "open"
+	// ErrorStageRead is when a file's contents could not be read.
+	ErrorStageRead ErrorStage = "read"
+)
+
+// A PathError is an error processing a path. Errno is the underlying system
+// error number, if any. Paths with errors are skipped, so any groups that
+// would have included them may be incomplete.
+type PathError struct {
+	Path  string        `json:"path"`
+	Stage ErrorStage    `json:"stage"`
+	Errno syscall.Errno `json:"errno,omitempty"`
+	Err   error         `json:"-"`
+}
+
+// newPathError returns a new PathError for path at stage caused by err.
+func newPathError(path string, stage ErrorStage, err error) *PathError {
+	// Avoid repeating the operation and path in the error message.
+	var fsPathError *fs.PathError
+	if errors.As(err, &fsPathError) {
+		err = fsPathError.Err
+	}
+	pathError := &PathError{
+		Path:  path,
+		Stage: stage,
+		Err:   err,
+	}
+	errors.As(err, &pathError.Errno)
+	return pathError
+}
+
+func (e *PathError) Error() string {
+	return string(e.Stage) + " " + e.Path + ": " + e.Err.Error()
+}
+
+// MarshalJSON implements encoding/json.Marshaler. The error message is
+// included as the error property.
+func (e *PathError) MarshalJSON() ([]byte, error) {
+	type pathError PathError
+	return json.Marshal(struct {
+		*pathError
+		Error string `json:"error"`
+	}{
+		pathError: (*pathError)(e),
+		Error:     e.Err.Error(),
+	})
+}
+
+func (e *PathError) Unwrap() error {
+	return e.Err
+}
@@ -0,0 +1,91 @@
+package dupfind
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/twpayne/find-duplicates/internal/ignore"
+)
+
+// An ignoreTree contains the matchers for the ignore files in the directories
+// walked in root, indexed by clean directory path.
+type ignoreTree struct {
+	root     string
+	names    []string
+	mutex    sync.Mutex
+	matchers map[string]*ignore.Matcher
+}
+
+// WithIgnoreFiles sets the names of ignore files, for example .gitignore. The
+// ignore files in each directory are read before the directory is walked, and
+// files and directories that they ignore are skipped, as is everything in
+// ignored directories. Ignore files have the same syntax and semantics as
+// .gitignore files, and patterns in later names take precedence over patterns
+// in earlier ones.
+func WithIgnoreFiles(names ...string) Option {
+	return func(f *DupFinder) {
+		f.ignoreFiles = append(f.ignoreFiles, names...)
+	}
+}
+
+// newIgnoreTree returns a new ignoreTree for the ignore files called names in
+// root.
+func newIgnoreTree(root string, names []string) *ignoreTree {
+	return &ignoreTree{
+		root:     filepath.Clean(root),
+		names:    names,
+		matchers: make(map[string]*ignore.Matcher),
+	}
+}
+
+// ignored returns whether path, found while walking t's root, is ignored.
+// isDir is whether path is a directory. The root itself is never ignored.
+func (t *ignoreTree) ignored(path string, isDir bool) bool {
+	path = filepath.Clean(path)
+	if path == t.root {
+		return false
+	}
+	t.mutex.Lock()
+	matcher := t.matchers[filepath.Dir(path)]
+	t.mutex.Unlock()
+	relPath, err := filepath.Rel(t.root, path)
+	if err != nil {
+		return false
+	}
+	return matcher.Match(filepath.ToSlash(relPath), isDir)
+}
+
+// readDir reads the ignore files in dir, which must be read before any entry
+// in dir is passed to t.ignored. handleError is called with the path of each
+// ignore file that cannot be read, which is skipped.
+func (t *ignoreTree) readDir(dir string, handleError func(path string, err error)) {
+	dir = filepath.Clean(dir)
+	var parent *ignore.Matcher
+	relDir := ""
+	if dir != t.root {
+		t.mutex.Lock()
+		parent = t.matchers[filepath.Dir(dir)]
+		t.mutex.Unlock()
+		if relPath, err := filepath.Rel(t.root, dir); err == nil {
+			relDir = filepath.ToSlash(relPath)
+		}
+	}
+	matcher := parent
+	for _, name := range t.names {
+		path := filepath.Join(dir, name)
+		data, err := os.ReadFile(path)
+		switch {
+		case errors.Is(err, fs.ErrNotExist):
+		case err != nil:
+			handleError(path, err)
+		default:
+			matcher = ignore.New(matcher, relDir, data)
+		}
+	}
+	t.mutex.Lock()
+	t.matchers[dir] = matcher
+	t.mutex.Unlock()
+}
@@ -0,0 +1,148 @@
+package dupfind
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// hashLatencyBuckets are the upper bounds of the buckets of the hash latency
+// histograms.
+var hashLatencyBuckets = [...]time.Duration{
+	100 * time.Microsecond,
+	time.Millisecond,
+	10 * time.Millisecond,
+	100 * time.Millisecond,
+	time.Second,
+	10 * time.Second,
+	100 * time.Second,
+}
+
+// hashStageNames are the names of the hash stages.
+var hashStageNames = [numHashStages]string{
+	hashStageHead: "head",
+	hashStageTail: "tail",
+	hashStageFull: "full",
+}
+
+// Metrics contains metrics that can be read while a search is running, in
+// addition to its [Statistics]. Queues are the queues between the stages of
+// the search, in pipeline order, and are only present while a search is
+// running. HashLatency contains a histogram of the time taken to hash each
+// file for each hashing stage.
+type Metrics struct {
+	Statistics  *Statistics
+	Queues      []Queue
+	HashLatency []LatencyHistogram
+}
+
+// A Queue is a queue between two stages of a search. Depth is the number of
+// items in the queue and Capacity is its maximum depth.
+type Queue struct {
+	Name     string
+	Depth    int
+	Capacity int
+}
+
+// A LatencyHistogram is a histogram of latencies for a hashing stage. Buckets
+// are cumulative, and the last bucket has no upper bound. Count is the total
+// number of observations and Sum is the sum of all observations.
+type LatencyHistogram struct {
+	Stage   string
+	Buckets []LatencyBucket
+	Count   uint64
+	Sum     time.Duration
+}
+
+// A LatencyBucket is a cumulative bucket in a [LatencyHistogram]. Count is the
+// number of observations less than or equal to UpperBound. The UpperBound of
+// the last bucket is zero, meaning that it has no upper bound.
+type LatencyBucket struct {
+	UpperBound time.Duration
+	Count      uint64
+}
+
+// A latencyHistogram is a histogram of latencies that is safe for concurrent
+// use. buckets are not cumulative.
+type latencyHistogram struct {
+	buckets [len(hashLatencyBuckets) + 1]atomic.Uint64
+	sum     atomic.Int64
+}
+
+// A queue is a channel between two stages of a search.
+type queue struct {
+	name     string
+	depth    func() int
+	capacity int
+}
+
+// newQueue returns a new queue for ch.
+func newQueue[T any](name string, ch chan T) queue {
+	return queue{
+		name:     name,
+		depth:    func() int { return len(ch) },
+		capacity: cap(ch),
+	}
+}
+
+// Metrics returns the current metrics. It is safe to call while a search is
+// running.
+func (f *DupFinder) Metrics() *Metrics {
+	f.queuesMutex.Lock()
+	queues := make([]Queue, 0, len(f.queues))
+	for _, queue := range f.queues {
+		queues = append(queues, Queue{
+			Name:     queue.name,
+			Depth:    queue.depth(),
+			Capacity: queue.capacity,
+		})
+	}
+	f.queuesMutex.Unlock()
+
+	hashLatency := make([]LatencyHistogram, 0, numHashStages)
+	for stage := range numHashStages {
+		latencyHistogram := f.statistics.stages[stage].hashLatency.load()
+		latencyHistogram.Stage = hashStageNames[stage]
+		hashLatency = append(hashLatency, latencyHistogram)
+	}
+
+	return &Metrics{
+		Statistics:  f.Statistics(),
+		Queues:      queues,
+		HashLatency: hashLatency,
+	}
+}
+
+// setQueues sets the queues of the running search.
+func (f *DupFinder) setQueues(queues []queue) {
+	f.queuesMutex.Lock()
+	defer f.queuesMutex.Unlock()
+	f.queues = queues
+}
+
+// load returns a snapshot of h.
+func (h *latencyHistogram) load() LatencyHistogram {
+	var latencyHistogram LatencyHistogram
+	for i := range h.buckets {
+		latencyHistogram.Count += h.buckets[i].Load()
+		var upperBound time.Duration
+		if i < len(hashLatencyBuckets) {
+			upperBound = hashLatencyBuckets[i]
+		}
+		latencyHistogram.Buckets = append(latencyHistogram.Buckets, LatencyBucket{
+			UpperBound: upperBound,
+			Count:      latencyHistogram.Count,
+		})
+	}
+	latencyHistogram.Sum = time.Duration(h.sum.Load())
+	return latencyHistogram
+}
+
+// observe records latency in h.
+func (h *latencyHistogram) observe(latency time.Duration) {
+	i := 0
+	for i < len(hashLatencyBuckets) && latency > hashLatencyBuckets[i] {
+		i++
+	}
+	h.buckets[i].Add(1)
+	h.sum.Add(int64(latency))
+}
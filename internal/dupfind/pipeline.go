@@ -0,0 +1,218 @@
+package dupfind
+
+import (
+	"context"
+	"iter"
+	"sync/atomic"
+	"time"
+
+	"github.com/twpayne/go-heap"
+)
+
+// A pipelineStage is a stage of the pipeline of goroutines that finds
+// duplicates.
+type pipelineStage int
+
+// Pipeline stages, in pipeline order.
+const (
+	pipelineStageWalk pipelineStage = iota
+	pipelineStageStat
+	pipelineStageUnique
+	pipelineStageSizes
+	pipelineStageHeadHash
+	pipelineStageHeadCollisions
+	pipelineStageTailHash
+	pipelineStageTailCollisions
+	pipelineStageFullHash
+	pipelineStageGroups
+	numPipelineStages
+)
+
+// pipelineStageNames are the names of the pipeline stages.
+var pipelineStageNames = [numPipelineStages]string{
+	pipelineStageWalk:           "walk",
+	pipelineStageStat:           "stat",
+	pipelineStageUnique:         "unique",
+	pipelineStageSizes:          "sizes",
+	pipelineStageHeadHash:       "head_hash",
+	pipelineStageHeadCollisions: "head_collisions",
+	pipelineStageTailHash:       "tail_hash",
+	pipelineStageTailCollisions: "tail_collisions",
+	pipelineStageFullHash:       "full_hash",
+	pipelineStageGroups:         "groups",
+}
+
+// hashPipelineStages and collisionsPipelineStages are the pipeline stages that
+// hash files and find collisions for each hashStage.
+var (
+	hashPipelineStages = [numHashStages]pipelineStage{
+		hashStageHead: pipelineStageHeadHash,
+		hashStageTail: pipelineStageTailHash,
+		hashStageFull: pipelineStageFullHash,
+	}
+	collisionsPipelineStages = [numHashStages]pipelineStage{
+		hashStageHead: pipelineStageHeadCollisions,
+		hashStageTail: pipelineStageTailCollisions,
+	}
+)
+
+// PipelineStageStatistics contains timing statistics for a single stage of
+// the pipeline. Start and End are the wall-clock times at which the stage
+// started processing its first item and finished processing its last, and
+// are zero if the stage did not process any items. BusySeconds is the total
+// time spent processing items, summed over all of the stage's goroutines, so
+// it can exceed DurationSeconds for concurrent stages. It includes time spent
+// waiting to send to the next stage but not time spent waiting for input.
+// Items is the number of items processed, where the items of the walk stage
+// are roots and the items of the stat stage are files. MaxQueueDepth is the
+// maximum number of items seen in the queue to the next stage, if any, which
+// has capacity QueueCapacity. If MaxQueueDepth reaches QueueCapacity then the
+// stage was limited by the next stage. BytesPerSecond is the hashing
+// throughput of stages that hash files.
+type PipelineStageStatistics struct {
+	Stage           string    `json:"stage"`
+	Start           time.Time `json:"start,omitzero"`
+	End             time.Time `json:"end,omitzero"`
+	DurationSeconds float64   `json:"durationSeconds"`
+	BusySeconds     float64   `json:"busySeconds"`
+	Items           uint64    `json:"items"`
+	MaxQueueDepth   int64     `json:"maxQueueDepth,omitempty"`
+	QueueCapacity   int64     `json:"queueCapacity,omitempty"`
+	BytesPerSecond  float64   `json:"bytesPerSecond,omitempty"`
+}
+
+// pipelineStageStatistics contains the statistics for a single pipelineStage.
+// Times are in nanoseconds since the Unix epoch.
+type pipelineStageStatistics struct {
+	start         atomic.Int64
+	end           atomic.Int64
+	busy          atomic.Int64
+	items         atomic.Uint64
+	maxQueueDepth atomic.Int64
+	queueCapacity atomic.Int64
+}
+
+// addItem records that an item that started being processed at start has
+// been processed.
+func (s *pipelineStageStatistics) addItem(start time.Time) {
+	end := time.Now()
+	s.start.CompareAndSwap(0, start.UnixNano())
+	for {
+		prevEnd := s.end.Load()
+		if end.UnixNano() <= prevEnd || s.end.CompareAndSwap(prevEnd, end.UnixNano()) {
+			break
+		}
+	}
+	s.busy.Add(int64(end.Sub(start)))
+	s.items.Add(1)
+}
+
+// load returns a snapshot of s for stage. bytesHashed is the number of bytes
+// hashed by the stage.
+func (s *pipelineStageStatistics) load(stage pipelineStage, bytesHashed uint64) PipelineStageStatistics {
+	pipelineStageStatistics := PipelineStageStatistics{
+		Stage:         pipelineStageNames[stage],
+		BusySeconds:   time.Duration(s.busy.Load()).Seconds(),
+		Items:         s.items.Load(),
+		MaxQueueDepth: s.maxQueueDepth.Load(),
+		QueueCapacity: s.queueCapacity.Load(),
+	}
+	if start, end := s.start.Load(), s.end.Load(); start != 0 {
+		pipelineStageStatistics.Start = time.Unix(0, start)
+		pipelineStageStatistics.End = time.Unix(0, end)
+		pipelineStageStatistics.DurationSeconds = time.Duration(end - start).Seconds()
+	}
+	if bytesHashed > 0 && pipelineStageStatistics.DurationSeconds > 0 {
+		pipelineStageStatistics.BytesPerSecond = float64(bytesHashed) / pipelineStageStatistics.DurationSeconds
+	}
+	return pipelineStageStatistics
+}
+
+// observeQueueDepth records that the queue to the next stage contains depth
+// items.
+func (s *pipelineStageStatistics) observeQueueDepth(depth int) {
+	for {
+		maxQueueDepth := s.maxQueueDepth.Load()
+		if int64(depth) <= maxQueueDepth || s.maxQueueDepth.CompareAndSwap(maxQueueDepth, int64(depth)) {
+			return
+		}
+	}
+}
+
+// receive returns an iterator over the values received from ch, recording the
+// time spent processing each value in s.
+func receive[T any](s *pipelineStageStatistics, ch <-chan T) iter.Seq[T] {
+	return func(yield func(T) bool) {
+		for value := range ch {
+			start := time.Now()
+			ok := yield(value)
+			s.addItem(start)
+			if !ok {
+				return
+			}
+		}
+	}
+}
+
+// send sends value to ch, unless ctx is done first. It returns whether value
+// was sent.
+func send[T any](ctx context.Context, ch chan<- T, value T) bool {
+	select {
+	case <-ctx.Done():
+		return false
+	case ch <- value:
+		return true
+	}
+}
+
+// sendToQueue sends value to ch, the queue to the next stage, unless ctx is
+// done first, recording the depth of ch in s. It returns whether value was
+// sent. As only the next stage removes items from ch, the depth of ch is at a
+// maximum immediately after a send.
+func sendToQueue[T any](ctx context.Context, s *pipelineStageStatistics, ch chan<- T, value T) bool {
+	if !send(ctx, ch, value) {
+		return false
+	}
+	s.queueCapacity.Store(int64(cap(ch)))
+	s.observeQueueDepth(len(ch))
+	return true
+}
+
+// priorityQueue returns a channel that receives the values sent to inCh,
+// lesser values first according to lessFunc. Up to capacity values are
+// buffered and ordered, after which sends to inCh block until a value is
+// received from the returned channel. The returned channel is closed once inCh
+// is closed and all values have been received, or once ctx is done.
+func priorityQueue[T any](ctx context.Context, inCh <-chan T, capacity int, lessFunc func(T, T) bool) <-chan T {
+	outCh := make(chan T)
+	go func() {
+		defer close(outCh)
+		values := heap.NewHeap(lessFunc)
+		for inCh != nil || !values.Empty() {
+			// Only receive if there is room in the buffer and only send if
+			// there is a value to send.
+			var receiveCh <-chan T
+			if values.Len() < capacity {
+				receiveCh = inCh
+			}
+			var sendCh chan<- T
+			value, ok := values.Peek()
+			if ok {
+				sendCh = outCh
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case receivedValue, ok := <-receiveCh:
+				if !ok {
+					inCh = nil
+					continue
+				}
+				values.Push(receivedValue)
+			case sendCh <- value:
+				values.MustPop()
+			}
+		}
+	}()
+	return outCh
+}
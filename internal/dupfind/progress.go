@@ -0,0 +1,95 @@
+package dupfind
+
+import (
+	"sync"
+	"time"
+)
+
+// A Progress is a snapshot of the progress of a search. FilesWalked is the
+// number of regular files found so far and Candidates is the number of those
+// that have the same size as another file and so need to be hashed.
+// BytesQueued is the number of bytes that will be read by all the hashing
+// stages for the files found so far, and BytesHashed is the number of those
+// bytes that have been read, including bytes whose hash was found in the
+// cache. BytesPerSecond is the throughput since the previous snapshot and ETA
+// is an estimate of the time remaining to hash the bytes queued so far, or
+// zero if it is unknown. Done is true for the final snapshot.
+type Progress struct {
+	Elapsed        time.Duration `json:"elapsed"`
+	FilesWalked    uint64        `json:"filesWalked"`
+	Candidates     uint64        `json:"candidates"`
+	BytesQueued    uint64        `json:"bytesQueued"`
+	BytesHashed    uint64        `json:"bytesHashed"`
+	BytesPerSecond float64       `json:"bytesPerSecond"`
+	ETA            time.Duration `json:"eta"`
+	Done           bool          `json:"done"`
+}
+
+// WithProgressFunc sets a function that is called with the progress of each
+// search every interval, and once more when the search finishes. interval must
+// be positive.
+func WithProgressFunc(interval time.Duration, progressFunc func(*Progress)) Option {
+	return func(f *DupFinder) {
+		f.progressInterval = interval
+		f.progressFunc = progressFunc
+	}
+}
+
+// reportProgress calls f.progressFunc every f.progressInterval in a new
+// goroutine until the returned function is called, which stops the goroutine
+// and calls f.progressFunc a final time.
+func (f *DupFinder) reportProgress() func() {
+	start := time.Now()
+	startFiles := f.statistics.files.Load()
+	startCandidates := f.statistics.candidates.Load()
+	startBytesQueued := f.statistics.bytesQueued.Load()
+	startBytesDone := f.statistics.bytesDone.Load()
+
+	// progress returns the progress at now, given the time and number of
+	// bytes hashed at the previous snapshot.
+	progress := func(now, prevTime time.Time, prevBytesHashed uint64) *Progress {
+		p := &Progress{
+			Elapsed:     now.Sub(start),
+			FilesWalked: f.statistics.files.Load() - startFiles,
+			Candidates:  f.statistics.candidates.Load() - startCandidates,
+			BytesQueued: f.statistics.bytesQueued.Load() - startBytesQueued,
+			BytesHashed: f.statistics.bytesDone.Load() - startBytesDone,
+		}
+		if seconds := now.Sub(prevTime).Seconds(); seconds > 0 {
+			p.BytesPerSecond = float64(p.BytesHashed-prevBytesHashed) / seconds
+		}
+		if p.BytesPerSecond > 0 && p.BytesQueued > p.BytesHashed {
+			p.ETA = time.Duration(float64(p.BytesQueued-p.BytesHashed) / p.BytesPerSecond * float64(time.Second))
+		}
+		return p
+	}
+
+	stopCh := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Go(func() {
+		ticker := time.NewTicker(f.progressInterval)
+		defer ticker.Stop()
+		prevTime := start
+		var prevBytesHashed uint64
+		for {
+			select {
+			case <-stopCh:
+				return
+			case now := <-ticker.C:
+				p := progress(now, prevTime, prevBytesHashed)
+				f.progressFunc(p)
+				prevTime = now
+				prevBytesHashed = p.BytesHashed
+			}
+		}
+	})
+
+	return func() {
+		close(stopCh)
+		wg.Wait()
+		// The final throughput is the average throughput.
+		p := progress(time.Now(), start, 0)
+		p.Done = true
+		f.progressFunc(p)
+	}
+}
@@ -0,0 +1,188 @@
+package dupfind
+
+import (
+	"cmp"
+	"context"
+	"maps"
+	"slices"
+	"strings"
+)
+
+// A SimilarDirectories is a pair of directories that contain files with
+// similar contents. Similarity is the Jaccard similarity of the sets of
+// contents of the files directly in each directory, weighted by size: the
+// number of bytes of contents in both directories, CommonBytes, divided by the
+// number of bytes of contents in either directory, TotalBytes. OnlyInA and
+// OnlyInB are the files whose contents are only in A or B respectively.
+type SimilarDirectories struct {
+	A           string   `json:"a"`
+	B           string   `json:"b"`
+	Similarity  float64  `json:"similarity"`
+	CommonBytes int64    `json:"commonBytes"`
+	TotalBytes  int64    `json:"totalBytes"`
+	OnlyInA     []string `json:"onlyInA"`
+	OnlyInB     []string `json:"onlyInB"`
+}
+
+// A directoryContents is the set of contents of the files directly in a
+// directory. Files whose contents have no duplicates are identified by their
+// path.
+type directoryContents struct {
+	path      string
+	sizes     map[string]int64
+	paths     map[string][]string
+	totalSize int64
+}
+
+// FindSimilarDirectories finds pairs of directories whose files have a
+// similarity of at least minSimilarity, see [SimilarDirectories]. Pairs are
+// sorted by similarity, most similar first. Directories are only compared if
+// they have at least one non-empty file in common. Only the pairs of
+// directories that could have at least minSimilarity are compared, so a low
+// minSimilarity can compare every pair of directories that share a file.
+func (f *DupFinder) FindSimilarDirectories(ctx context.Context, minSimilarity float64) ([]*SimilarDirectories, error) {
+	result, err := f.findFiles(ctx, findModeDirectories)
+	if err != nil {
+		return nil, err
+	}
+	contentIndex := newContentIndex(result)
+
+	// Find the contents of each directory.
+	var allDirectoryContents []*directoryContents
+	for _, path := range slices.Sorted(maps.Keys(f.tree.directories)) {
+		directory := f.tree.directories[path]
+		if !directory.walked || directory.incomplete {
+			continue
+		}
+		contents := &directoryContents{
+			path:  path,
+			sizes: make(map[string]int64),
+			paths: make(map[string][]string),
+		}
+		for _, entry := range directory.entries {
+			if entry.typ != 0 {
+				continue
+			}
+			key, ok := contentIndex.key(entry.pathWithSize)
+			if !ok {
+				key = "\x00" + entry.path
+			}
+			if _, ok := contents.sizes[key]; !ok {
+				contents.sizes[key] = entry.size
+				contents.totalSize += entry.size
+			}
+			contents.paths[key] = append(contents.paths[key], entry.path)
+		}
+		if len(contents.sizes) > 0 {
+			allDirectoryContents = append(allDirectoryContents, contents)
+		}
+	}
+
+	// Find the candidate pairs of directories. Order each directory's contents
+	// from the rarest to the most common and index the directory by its
+	// prefix: the contents before the remaining contents are smaller than
+	// minSimilarity of the directory. A pair of directories with at least
+	// minSimilarity must have bytes in common that are greater than that, so
+	// the first contents they have in common in this order are in both of
+	// their prefixes. Contents that are common to many directories, like
+	// small boilerplate files, are last and so are rarely indexed.
+	frequencies := make(map[string]int)
+	for _, contents := range allDirectoryContents {
+		for key := range contents.sizes {
+			frequencies[key]++
+		}
+	}
+	directoriesByKey := make(map[string][]int)
+	for i, contents := range allDirectoryContents {
+		keys := slices.SortedFunc(maps.Keys(contents.sizes), func(a, b string) int {
+			return cmp.Or(
+				cmp.Compare(frequencies[a], frequencies[b]),
+				strings.Compare(a, b),
+			)
+		})
+		minCommonBytes := minSimilarity * float64(contents.totalSize)
+		remaining := contents.totalSize
+		for _, key := range keys {
+			if float64(remaining) < minCommonBytes {
+				break
+			}
+			size := contents.sizes[key]
+			remaining -= size
+			if size > 0 && key[0] != '\x00' {
+				directoriesByKey[key] = append(directoriesByKey[key], i)
+			}
+		}
+	}
+	candidates := make(map[[2]int]struct{})
+	for _, directories := range directoriesByKey {
+		for i, a := range directories {
+			for _, b := range directories[i+1:] {
+				// The similarity of a pair is at most the ratio of their
+				// total sizes.
+				aTotalSize := float64(allDirectoryContents[a].totalSize)
+				bTotalSize := float64(allDirectoryContents[b].totalSize)
+				if min(aTotalSize, bTotalSize) < minSimilarity*max(aTotalSize, bTotalSize) {
+					continue
+				}
+				candidates[[2]int{a, b}] = struct{}{}
+			}
+		}
+	}
+
+	// Report the pairs with at least minSimilarity.
+	var similarDirectories []*SimilarDirectories
+	for pair := range candidates {
+		a, b := allDirectoryContents[pair[0]], allDirectoryContents[pair[1]]
+		common := a.commonBytes(b)
+		total := a.totalSize + b.totalSize - common
+		similarity := float64(common) / float64(total)
+		if similarity < minSimilarity {
+			continue
+		}
+		similarDirectories = append(similarDirectories, &SimilarDirectories{
+			A:           a.path,
+			B:           b.path,
+			Similarity:  similarity,
+			CommonBytes: common,
+			TotalBytes:  total,
+			OnlyInA:     a.pathsNotIn(b),
+			OnlyInB:     b.pathsNotIn(a),
+		})
+	}
+	slices.SortFunc(similarDirectories, func(a, b *SimilarDirectories) int {
+		return cmp.Or(
+			cmp.Compare(b.Similarity, a.Similarity),
+			strings.Compare(a.A, b.A),
+			strings.Compare(a.B, b.B),
+		)
+	})
+	return similarDirectories, nil
+}
+
+// commonBytes returns the number of bytes of non-empty contents that are in
+// both c and other.
+func (c *directoryContents) commonBytes(other *directoryContents) int64 {
+	if len(other.sizes) < len(c.sizes) {
+		c, other = other, c
+	}
+	var commonBytes int64
+	for key, size := range c.sizes {
+		if _, ok := other.sizes[key]; ok && key[0] != '\x00' {
+			commonBytes += size
+		}
+	}
+	return commonBytes
+}
+
+// pathsNotIn returns the paths of the files in c whose contents are not in
+// other.
+func (c *directoryContents) pathsNotIn(other *directoryContents) []string {
+	paths := []string{}
+	for key, keyPaths := range c.paths {
+		if _, ok := other.sizes[key]; !ok {
+			paths = append(paths, keyPaths...)
+		}
+	}
+	slices.Sort(paths)
+	return paths
+}
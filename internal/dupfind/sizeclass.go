@@ -0,0 +1,47 @@
+package dupfind
+
+// A sizeClass tracks the paths with the same size in a single stage of the
+// pipeline. Once a stage has sent all of its paths with a given size, it sends
+// a pathWithHash with done set and count set to the number of paths that it
+// sent. The size class in the next stage is complete once that stage has
+// processed all of them, at which point no more paths with that size can
+// arrive.
+type sizeClass struct {
+	expected    int
+	processed   int
+	sent        int
+	pathsByHash map[string][]pathWithHash
+}
+
+// sizeClasses is a map of sizes to sizeClasses.
+type sizeClasses map[int64]*sizeClass
+
+// complete returns whether all of the paths in s have been processed.
+func (s *sizeClass) complete() bool {
+	return s.processed == s.expected
+}
+
+// doneMarker returns a pathWithHash that indicates that all count paths with
+// size have been sent.
+func doneMarker(size int64, count int) pathWithHash {
+	return pathWithHash{
+		pathWithSize: pathWithSize{
+			size: size,
+		},
+		done:  true,
+		count: count,
+	}
+}
+
+// get returns the sizeClass for size, creating it if needed.
+func (s sizeClasses) get(size int64) *sizeClass {
+	sc, ok := s[size]
+	if !ok {
+		sc = &sizeClass{
+			expected:    -1,
+			pathsByHash: make(map[string][]pathWithHash),
+		}
+		s[size] = sc
+	}
+	return sc
+}
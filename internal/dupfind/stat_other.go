@@ -0,0 +1,10 @@
+//go:build !unix
+
+package dupfind
+
+import "io/fs"
+
+// inodeAndNlink returns the inode of fileInfo and its number of hard links.
+func inodeAndNlink(fs.FileInfo) (inode, uint64, bool) {
+	return inode{}, 0, false
+}
@@ -0,0 +1,21 @@
+//go:build unix
+
+package dupfind
+
+import (
+	"io/fs"
+	"syscall"
+)
+
+// inodeAndNlink returns the inode of fileInfo and its number of hard links.
+func inodeAndNlink(fileInfo fs.FileInfo) (inode, uint64, bool) {
+	stat, ok := fileInfo.Sys().(*syscall.Stat_t)
+	if !ok {
+		return inode{}, 0, false
+	}
+	inode := inode{
+		dev: uint64(stat.Dev), //nolint:gosec,unconvert
+		ino: uint64(stat.Ino), //nolint:unconvert
+	}
+	return inode, uint64(stat.Nlink), true //nolint:unconvert
+}
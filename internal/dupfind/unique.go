@@ -0,0 +1,54 @@
+package dupfind
+
+import (
+	"context"
+	"slices"
+	"strings"
+)
+
+// FindUnique finds the files whose contents do not match any file in another
+// root or, if there are reference roots, any file in a reference root. If
+// there is only one root and no reference roots then it finds the files whose
+// contents do not match any other file. Files in reference roots are never
+// reported. Files whose size is unique are not hashed. The files are sorted by
+// path.
+func (f *DupFinder) FindUnique(ctx context.Context) ([]File, error) {
+	result, err := f.findFiles(ctx, findModeUnique)
+	if err != nil {
+		return nil, err
+	}
+
+	var unique []File
+	for _, p := range f.unique {
+		if !p.reference {
+			unique = append(unique, p.file())
+		}
+	}
+
+	// Files with duplicates are unique if none of their duplicates are in
+	// another root, or in a reference root.
+	for _, group := range result.Groups {
+		filesByRoot := make(map[string]int)
+		references := 0
+		for _, file := range group.Files {
+			filesByRoot[file.Root]++
+			if file.Reference {
+				references++
+			}
+		}
+		for _, file := range group.Files {
+			switch {
+			case file.Reference:
+			case len(f.referenceRoots) > 0 && references == 0:
+				unique = append(unique, file)
+			case len(f.referenceRoots) == 0 && len(f.roots) > 1 && filesByRoot[file.Root] == len(group.Files):
+				unique = append(unique, file)
+			}
+		}
+	}
+
+	slices.SortFunc(unique, func(a, b File) int {
+		return strings.Compare(a.Path, b.Path)
+	})
+	return unique, nil
+}
@@ -0,0 +1,101 @@
+package dupfind
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"slices"
+)
+
+// verifyFiles splits files, which all have the same hash, into groups of files
+// whose contents are identical, byte for byte. Once ctx is done, it returns
+// no groups.
+func (f *DupFinder) verifyFiles(ctx context.Context, files []File, errCh chan<- error) [][]File {
+	var groups [][]File
+FOR:
+	for _, file := range files {
+		for i, group := range groups {
+			identical, err := f.identicalContents(ctx, group[0], file)
+			switch {
+			case ctx.Err() != nil:
+				return nil
+			case err != nil:
+				send(ctx, errCh, err)
+				continue FOR
+			}
+			if identical {
+				groups[i] = append(group, file)
+				continue FOR
+			}
+		}
+		groups = append(groups, []File{file})
+	}
+	if len(groups) > 1 {
+		f.statistics.collisions.Add(uint64(len(groups) - 1))
+	}
+	return groups
+}
+
+// identicalContents returns whether file1 and file2 have identical contents.
+// Like hashing, comparing holds the semaphores of the files' devices and
+// counts against the limit on open files.
+func (f *DupFinder) identicalContents(ctx context.Context, file1, file2 File) (bool, error) {
+	// Acquire device semaphores in a consistent order, and each device's
+	// semaphore only once, so that comparisons cannot deadlock.
+	devs := []uint64{file1.Dev, file2.Dev}
+	slices.Sort(devs)
+	for _, dev := range slices.Compact(devs) {
+		deviceSemaphore := f.deviceSemaphore(dev)
+		if !send(ctx, deviceSemaphore, struct{}{}) {
+			return false, ctx.Err()
+		}
+		defer func() {
+			<-deviceSemaphore
+		}()
+	}
+	// Both files are open at once, so take two open files, or one if only
+	// one file may be open.
+	for range min(2, cap(f.openFiles)) {
+		if !send(ctx, f.openFiles, struct{}{}) {
+			return false, ctx.Err()
+		}
+		defer func() {
+			<-f.openFiles
+		}()
+	}
+
+	path1, path2 := file1.Path, file2.Path
+	reader1, err := openFile(path1, file1.member)
+	if err != nil {
+		return false, newPathError(path1, ErrorStageOpen, err)
+	}
+	defer reader1.Close()
+	reader2, err := openFile(path2, file2.member)
+	if err != nil {
+		return false, newPathError(path2, ErrorStageOpen, err)
+	}
+	defer reader2.Close()
+
+	buffer1 := make([]byte, 64<<10)
+	buffer2 := make([]byte, 64<<10)
+	for {
+		if err := ctx.Err(); err != nil {
+			return false, err
+		}
+		n1, err1 := io.ReadFull(reader1, buffer1)
+		if err1 != nil && !errors.Is(err1, io.EOF) && !errors.Is(err1, io.ErrUnexpectedEOF) {
+			return false, newPathError(path1, ErrorStageRead, err1)
+		}
+		n2, err2 := io.ReadFull(reader2, buffer2)
+		if err2 != nil && !errors.Is(err2, io.EOF) && !errors.Is(err2, io.ErrUnexpectedEOF) {
+			return false, newPathError(path2, ErrorStageRead, err2)
+		}
+		if !bytes.Equal(buffer1[:n1], buffer2[:n2]) {
+			return false, nil
+		}
+		if err1 != nil || err2 != nil {
+			return err1 != nil && err2 != nil, nil
+		}
+	}
+}
@@ -0,0 +1,136 @@
+// Package filter implements ordered include and exclude rules for paths.
+package filter
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/bmatcuk/doublestar/v4"
+)
+
+// An Action is what a Rule does to the paths that it matches.
+type Action int
+
+// Actions.
+const (
+	Exclude Action = iota
+	Include
+)
+
+// A Type is the type of a Rule's pattern.
+type Type int
+
+// Types.
+const (
+	// Glob patterns are doublestar patterns. Patterns that contain a slash
+	// are matched against the path relative to the root, and a leading slash
+	// anchors them at the root. Patterns with a leading slash are also
+	// matched against the absolute path, so absolute patterns still match.
+	// Other patterns are matched against the basename.
+	Glob Type = iota
+	// Regexp patterns are regular expressions that are matched against the
+	// path relative to the root. They are not anchored.
+	Regexp
+)
+
+// A Rule includes or excludes the paths that match a pattern. If IgnoreCase
+// is true then the pattern is matched case-insensitively.
+type Rule struct {
+	Action     Action
+	Type       Type
+	Pattern    string
+	IgnoreCase bool
+}
+
+// A Filter determines which paths are included by applying rules in order,
+// where later rules override earlier ones. Directories that are not matched by
+// any rule are included. Files that are not matched by any rule are included,
+// unless the first rule is an include rule.
+type Filter struct {
+	rules          []rule
+	includeDefault bool
+}
+
+// A rule is a compiled Rule.
+type rule struct {
+	include bool
+	match   func(absPath, relPath string) bool
+}
+
+// New returns a new Filter with rules.
+func New(rules ...Rule) (*Filter, error) {
+	f := &Filter{
+		rules:          make([]rule, 0, len(rules)),
+		includeDefault: len(rules) == 0 || rules[0].Action != Include,
+	}
+	for _, r := range rules {
+		match, err := r.compile()
+		if err != nil {
+			return nil, err
+		}
+		f.rules = append(f.rules, rule{
+			include: r.Action == Include,
+			match:   match,
+		})
+	}
+	return f, nil
+}
+
+// Include returns whether relPath, a slash-separated path relative to a root,
+// is included. absPath is the same path as an absolute slash-separated path.
+// isDir is whether relPath is a directory.
+func (f *Filter) Include(absPath, relPath string, isDir bool) bool {
+	for i := len(f.rules) - 1; i >= 0; i-- {
+		if f.rules[i].match(absPath, relPath) {
+			return f.rules[i].include
+		}
+	}
+	return isDir || f.includeDefault
+}
+
+// compile returns a function that returns whether r's pattern matches a path.
+func (r Rule) compile() (func(absPath, relPath string) bool, error) {
+	switch r.Type {
+	case Glob:
+		absPattern := r.Pattern
+		if r.IgnoreCase {
+			absPattern = strings.ToLower(absPattern)
+		}
+		matchPath := strings.Contains(absPattern, "/")
+		matchAbsPath := strings.HasPrefix(absPattern, "/")
+		pattern := strings.TrimPrefix(absPattern, "/")
+		if !doublestar.ValidatePattern(pattern) {
+			return nil, fmt.Errorf("%s: invalid pattern", r.Pattern)
+		}
+		return func(absPath, relPath string) bool {
+			if r.IgnoreCase {
+				absPath = strings.ToLower(absPath)
+				relPath = strings.ToLower(relPath)
+			}
+			switch {
+			case !matchPath:
+				return doublestar.MatchUnvalidated(pattern, path.Base(relPath))
+			case matchAbsPath && doublestar.MatchUnvalidated(absPattern, absPath):
+				return true
+			default:
+				return doublestar.MatchUnvalidated(pattern, relPath)
+			}
+		}, nil
+	case Regexp:
+		expr := r.Pattern
+		if r.IgnoreCase {
+			expr = "(?i)" + expr
+		}
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, fmt.Errorf("%s: invalid regular expression: %w", r.Pattern, err)
+		}
+		return func(_, relPath string) bool {
+			return re.MatchString(relPath)
+		}, nil
+	default:
+		return nil, fmt.Errorf("%d: invalid type", r.Type)
+	}
+}
@@ -0,0 +1,146 @@
+package filter_test
+
+import (
+	"testing"
+
+	"github.com/alecthomas/assert/v2"
+
+	"github.com/twpayne/find-duplicates/internal/filter"
+)
+
+func TestFilter(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		rules    []filter.Rule
+		expected map[string]bool
+	}{
+		{
+			name: "empty",
+			expected: map[string]bool{
+				"a":     true,
+				"a/b.c": true,
+			},
+		},
+		{
+			name: "exclude_basename",
+			rules: []filter.Rule{
+				{Action: filter.Exclude, Pattern: "*.tmp"},
+			},
+			expected: map[string]bool{
+				"a.tmp":     false,
+				"a/b.tmp":   false,
+				"a/b.txt":   true,
+				"a.tmp/b.c": true,
+			},
+		},
+		{
+			name: "exclude_path",
+			rules: []filter.Rule{
+				{Action: filter.Exclude, Pattern: "/a/*.tmp"},
+			},
+			expected: map[string]bool{
+				"a.tmp":     true,
+				"a/b.tmp":   false,
+				"a/b/c.tmp": true,
+				"b/a/c.tmp": true,
+			},
+		},
+		{
+			name: "include",
+			rules: []filter.Rule{
+				{Action: filter.Include, Pattern: "*.{jpg,png}"},
+			},
+			expected: map[string]bool{
+				"a.jpg":   true,
+				"a/b.png": true,
+				"a/b.txt": false,
+				"a.JPG":   false,
+			},
+		},
+		{
+			name: "include_ignore_case",
+			rules: []filter.Rule{
+				{Action: filter.Include, Pattern: "**/photos/*.jpg", IgnoreCase: true},
+			},
+			expected: map[string]bool{
+				"Photos/a.JPG":   true,
+				"a/PHOTOS/b.jpg": true,
+				"a/b.jpg":        false,
+			},
+		},
+		{
+			name: "later_rules_override_earlier_ones",
+			rules: []filter.Rule{
+				{Action: filter.Include, Pattern: "*.jpg"},
+				{Action: filter.Exclude, Pattern: "thumbnails/*"},
+				{Action: filter.Include, Pattern: "thumbnails/keep.jpg"},
+			},
+			expected: map[string]bool{
+				"a.jpg":               true,
+				"a.png":               false,
+				"thumbnails/a.jpg":    false,
+				"thumbnails/keep.jpg": true,
+			},
+		},
+		{
+			name: "regexp",
+			rules: []filter.Rule{
+				{Action: filter.Exclude, Type: filter.Regexp, Pattern: `\.bak$`},
+				{Action: filter.Include, Type: filter.Regexp, Pattern: `^keep/`, IgnoreCase: true},
+			},
+			expected: map[string]bool{
+				"a.bak":      false,
+				"a/b.bak":    false,
+				"a.bak/b":    true,
+				"KEEP/a.bak": true,
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			f, err := filter.New(tc.rules...)
+			assert.NoError(t, err)
+			for relPath, expected := range tc.expected {
+				assert.Equal(t, expected, f.Include("/root/"+relPath, relPath, false), relPath)
+			}
+		})
+	}
+}
+
+func TestFilterDirectories(t *testing.T) {
+	f, err := filter.New(
+		filter.Rule{Action: filter.Include, Pattern: "*.jpg"},
+		filter.Rule{Action: filter.Exclude, Pattern: "cache"},
+	)
+	assert.NoError(t, err)
+	assert.True(t, f.Include("/root/a", "a", true))
+	assert.False(t, f.Include("/root/a", "a", false))
+	assert.False(t, f.Include("/root/a/cache", "a/cache", true))
+}
+
+func TestFilterAbsolutePatterns(t *testing.T) {
+	f, err := filter.New(
+		filter.Rule{Action: filter.Exclude, Pattern: "/data/photos/**"},
+		filter.Rule{Action: filter.Exclude, Pattern: "/DATA/TMP/*", IgnoreCase: true},
+	)
+	assert.NoError(t, err)
+
+	// Absolute patterns match the absolute path, whatever the root.
+	assert.False(t, f.Include("/data/photos/a.jpg", "photos/a.jpg", false))
+	assert.False(t, f.Include("/data/photos/a.jpg", "a.jpg", false))
+	assert.False(t, f.Include("/data/tmp/a", "tmp/a", false))
+	assert.True(t, f.Include("/data/music/a.mp3", "music/a.mp3", false))
+
+	// They are also anchored at the root.
+	assert.False(t, f.Include("/mnt/data/photos/a.jpg", "data/photos/a.jpg", false))
+	assert.True(t, f.Include("/mnt/x/data/photos/a.jpg", "x/data/photos/a.jpg", false))
+}
+
+func TestFilterInvalid(t *testing.T) {
+	for _, rule := range []filter.Rule{
+		{Pattern: "[a"},
+		{Type: filter.Regexp, Pattern: "(a"},
+	} {
+		_, err := filter.New(rule)
+		assert.Error(t, err)
+	}
+}
@@ -0,0 +1,163 @@
+// Package hashcache implements a persistent cache of hashes.
+package hashcache
+
+import (
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/twpayne/find-duplicates/internal/dupfind"
+)
+
+// version is the version of the cache file format.
+const version = 1
+
+// A Cache is a persistent cache of hashes, stored in a single file.
+type Cache struct {
+	name     string
+	mutex    sync.Mutex
+	entries  map[dupfind.HashCacheKey]*entry
+	modified bool
+}
+
+// An entry is a cached hash.
+type entry struct {
+	hash string
+	used bool
+}
+
+// A file is the on-disk representation of a cache.
+type file struct {
+	Version int
+	Records []record
+}
+
+// A record is the on-disk representation of a cache entry.
+type record struct {
+	Key  dupfind.HashCacheKey
+	Hash string
+}
+
+// Open returns a new [*Cache] stored in the file name. If name does not exist
+// then the cache is initially empty.
+func Open(name string) (*Cache, error) {
+	c := &Cache{
+		name:    name,
+		entries: make(map[dupfind.HashCacheKey]*entry),
+	}
+	osFile, err := os.Open(name)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		return c, nil
+	case err != nil:
+		return nil, err
+	}
+	defer osFile.Close()
+	var f file
+	if err := gob.NewDecoder(osFile).Decode(&f); err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	if f.Version != version {
+		return nil, fmt.Errorf("%s: unsupported version %d", name, f.Version)
+	}
+	for _, record := range f.Records {
+		c.entries[record.Key] = &entry{
+			hash: record.Hash,
+		}
+	}
+	return c, nil
+}
+
+// Get implements [dupfind.HashCache.Get].
+func (c *Cache) Get(key dupfind.HashCacheKey) (string, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	entry, ok := c.entries[key]
+	if !ok {
+		return "", false
+	}
+	entry.used = true
+	return entry.hash, true
+}
+
+// Len returns the number of entries in c.
+func (c *Cache) Len() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return len(c.entries)
+}
+
+// Prune removes all entries that have not been used since c was opened.
+func (c *Cache) Prune() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for key, entry := range c.entries {
+		if !entry.used {
+			delete(c.entries, key)
+			c.modified = true
+		}
+	}
+}
+
+// Save writes c to its file, if c has been modified since it was opened or
+// last saved. The file is replaced atomically so that an interrupted write does
+// not corrupt an existing cache.
+func (c *Cache) Save() error {
+	c.mutex.Lock()
+	if !c.modified {
+		c.mutex.Unlock()
+		return nil
+	}
+	f := file{
+		Version: version,
+		Records: make([]record, 0, len(c.entries)),
+	}
+	for key, entry := range c.entries {
+		f.Records = append(f.Records, record{
+			Key:  key,
+			Hash: entry.hash,
+		})
+	}
+	c.modified = false
+	c.mutex.Unlock()
+
+	if err := c.write(&f); err != nil {
+		c.mutex.Lock()
+		c.modified = true
+		c.mutex.Unlock()
+		return err
+	}
+	return nil
+}
+
+// Set implements [dupfind.HashCache.Set].
+func (c *Cache) Set(key dupfind.HashCacheKey, hash string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.entries[key] = &entry{
+		hash: hash,
+		used: true,
+	}
+	c.modified = true
+}
+
+// write replaces c's file with f.
+func (c *Cache) write(f *file) error {
+	tempFile, err := os.CreateTemp(filepath.Dir(c.name), filepath.Base(c.name)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tempFile.Name())
+	if err := gob.NewEncoder(tempFile).Encode(f); err != nil {
+		tempFile.Close()
+		return err
+	}
+	if err := tempFile.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tempFile.Name(), c.name)
+}
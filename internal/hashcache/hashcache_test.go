@@ -0,0 +1,181 @@
+package hashcache_test
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/gob"
+	"errors"
+	"hash"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/alecthomas/assert/v2"
+	"github.com/twpayne/go-vfs/v5/vfst"
+
+	"github.com/twpayne/find-duplicates/internal/dupfind"
+	"github.com/twpayne/find-duplicates/internal/hashcache"
+)
+
+func TestCache(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "cache")
+	key1 := dupfind.HashCacheKey{Dev: 1, Ino: 1, Size: 1, Algorithm: "sha256", Length: 1}
+	key2 := dupfind.HashCacheKey{Dev: 1, Ino: 2, Size: 1, Algorithm: "sha256", Length: 1}
+
+	cache, err := hashcache.Open(name)
+	assert.NoError(t, err)
+	_, ok := cache.Get(key1)
+	assert.False(t, ok)
+	cache.Set(key1, "hash1")
+	cache.Set(key2, "hash2")
+	assert.NoError(t, cache.Save())
+
+	cache, err = hashcache.Open(name)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, cache.Len())
+	hash, ok := cache.Get(key1)
+	assert.True(t, ok)
+	assert.Equal(t, "hash1", hash)
+	_, ok = cache.Get(dupfind.HashCacheKey{Dev: 1, Ino: 1, Size: 1, Algorithm: "sha512", Length: 1})
+	assert.False(t, ok)
+
+	cache.Prune()
+	assert.Equal(t, 1, cache.Len())
+	assert.NoError(t, cache.Save())
+
+	cache, err = hashcache.Open(name)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, cache.Len())
+}
+
+func TestCacheSaveUnmodified(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "cache")
+	key := dupfind.HashCacheKey{Dev: 1, Ino: 1, Size: 1, Algorithm: "sha256", Length: 1}
+
+	// An empty cache is not written.
+	cache, err := hashcache.Open(name)
+	assert.NoError(t, err)
+	assert.NoError(t, cache.Save())
+	_, err = os.Stat(name)
+	assert.IsError(t, err, os.ErrNotExist)
+
+	cache.Set(key, "hash")
+	assert.NoError(t, cache.Save())
+	assert.NoError(t, os.Remove(name))
+
+	// Using the cache or pruning nothing does not modify it, so it is not
+	// written again.
+	_, ok := cache.Get(key)
+	assert.True(t, ok)
+	cache.Prune()
+	assert.NoError(t, cache.Save())
+	_, err = os.Stat(name)
+	assert.IsError(t, err, os.ErrNotExist)
+
+	cache.Set(key, "hash")
+	assert.NoError(t, cache.Save())
+	_, err = os.Stat(name)
+	assert.NoError(t, err)
+}
+
+func TestCacheSaveError(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "dir")
+	name := filepath.Join(dir, "cache")
+	key := dupfind.HashCacheKey{Dev: 1, Ino: 1, Size: 1, Algorithm: "sha256", Length: 1}
+
+	cache, err := hashcache.Open(name)
+	assert.NoError(t, err)
+	cache.Set(key, "hash")
+	assert.Error(t, cache.Save())
+
+	// The cache is still modified, so saving again once the directory exists
+	// writes it.
+	assert.NoError(t, os.Mkdir(dir, 0o777))
+	assert.NoError(t, cache.Save())
+	cache, err = hashcache.Open(name)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, cache.Len())
+}
+
+func TestCacheOpenErrors(t *testing.T) {
+	dir := t.TempDir()
+
+	corrupt := filepath.Join(dir, "corrupt")
+	assert.NoError(t, os.WriteFile(corrupt, []byte("not a cache"), 0o666))
+	_, err := hashcache.Open(corrupt)
+	assert.Error(t, err)
+
+	future := filepath.Join(dir, "future")
+	osFile, err := os.Create(future)
+	assert.NoError(t, err)
+	assert.NoError(t, gob.NewEncoder(osFile).Encode(struct{ Version int }{Version: 2}))
+	assert.NoError(t, osFile.Close())
+	_, err = hashcache.Open(future)
+	assert.EqualError(t, err, future+": unsupported version 2")
+}
+
+func TestCacheSaveAfterCancel(t *testing.T) {
+	fs, cleanup, err := vfst.NewTestFS(map[string]any{
+		"alpha": "a",
+		"beta":  "a",
+		"gamma": "bb",
+		"delta": "bb",
+	})
+	assert.NoError(t, err)
+	defer cleanup()
+	name := filepath.Join(t.TempDir(), "cache")
+
+	// Cancel the search once the smaller files have been hashed, while the
+	// larger files are still being hashed.
+	ctx, cancel := context.WithCancel(t.Context())
+	defer cancel()
+	cache, err := hashcache.Open(name)
+	assert.NoError(t, err)
+	dupFinder := dupfind.NewDupFinder(
+		dupfind.WithGroupFunc(func(group *dupfind.Group) error {
+			if group.Size == 1 {
+				cancel()
+			}
+			return nil
+		}),
+		dupfind.WithHashCache(cache, "sha256"),
+		dupfind.WithHashFunc(func() hash.Hash {
+			return &blockingHash{
+				Hash:      sha256.New(),
+				blockSize: 2,
+				unblockCh: ctx.Done(),
+			}
+		}),
+		dupfind.WithRoots(fs.TempDir()),
+	)
+	_, err = dupFinder.FindDuplicates(ctx)
+	assert.IsError(t, err, context.Canceled)
+	assert.NoError(t, cache.Save())
+
+	// Only the hashes of the smaller files were computed before the search
+	// was cancelled.
+	cache, err = hashcache.Open(name)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, cache.Len())
+}
+
+// A blockingHash is a hash that blocks writes of blockSize bytes until
+// unblockCh is closed, and then fails them.
+type blockingHash struct {
+	hash.Hash
+	blockSize int
+	unblockCh <-chan struct{}
+}
+
+func (h *blockingHash) Write(p []byte) (int, error) {
+	if len(p) == h.blockSize {
+		select {
+		case <-h.unblockCh:
+			return 0, errors.New("unblocked")
+		case <-time.After(10 * time.Second):
+			return 0, errors.New("timeout")
+		}
+	}
+	return h.Hash.Write(p)
+}
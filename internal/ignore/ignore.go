@@ -0,0 +1,141 @@
+// Package ignore implements ignore files with the same syntax and semantics
+// as .gitignore files.
+//
+// See https://git-scm.com/docs/gitignore.
+package ignore
+
+import (
+	"bytes"
+	"path"
+	"strings"
+
+	"github.com/bmatcuk/doublestar/v4"
+)
+
+// A Matcher matches paths against the patterns in an ignore file and in the
+// ignore files of its parent directories.
+type Matcher struct {
+	parent   *Matcher
+	dir      string
+	patterns []pattern
+}
+
+// A pattern is a single pattern in an ignore file. glob is a doublestar
+// pattern. If negate is true then paths that match are not ignored. If dirOnly
+// is true then only directories match. If anchored is true then glob is
+// matched against the path relative to the ignore file's directory, otherwise
+// it is matched against the basename.
+type pattern struct {
+	glob     string
+	negate   bool
+	dirOnly  bool
+	anchored bool
+}
+
+// New returns a new Matcher for the ignore file with contents data in dir,
+// which is a slash-separated path relative to the root, or the empty string
+// for the root itself. parent matches the ignore files in dir and its parent
+// directories that have already been read and may be nil. Patterns in data
+// take precedence over patterns in parent. If data contains no patterns then
+// parent is returned.
+func New(parent *Matcher, dir string, data []byte) *Matcher {
+	var patterns []pattern
+	for line := range bytes.Lines(data) {
+		if pattern, ok := parsePattern(string(line)); ok {
+			patterns = append(patterns, pattern)
+		}
+	}
+	if len(patterns) == 0 {
+		return parent
+	}
+	return &Matcher{
+		parent:   parent,
+		dir:      dir,
+		patterns: patterns,
+	}
+}
+
+// Match returns whether relPath, a slash-separated path relative to the root,
+// is ignored. isDir is whether relPath is a directory. The last matching
+// pattern in the deepest ignore file determines whether relPath is ignored.
+func (m *Matcher) Match(relPath string, isDir bool) bool {
+	for ; m != nil; m = m.parent {
+		rel := relPath
+		if m.dir != "" {
+			var ok bool
+			rel, ok = strings.CutPrefix(relPath, m.dir+"/")
+			if !ok {
+				continue
+			}
+		}
+		for i := len(m.patterns) - 1; i >= 0; i-- {
+			pattern := &m.patterns[i]
+			if pattern.dirOnly && !isDir {
+				continue
+			}
+			name := rel
+			if !pattern.anchored {
+				name = path.Base(rel)
+			}
+			if doublestar.MatchUnvalidated(pattern.glob, name) {
+				return !pattern.negate
+			}
+		}
+	}
+	return false
+}
+
+// parsePattern parses line from an ignore file. It returns false if line does
+// not contain a valid pattern.
+func parsePattern(line string) (pattern, bool) {
+	line = strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r")
+	if line == "" || strings.HasPrefix(line, "#") {
+		return pattern{}, false
+	}
+
+	// Remove trailing spaces, unless they are escaped with a backslash.
+	for strings.HasSuffix(line, " ") && !strings.HasSuffix(line, `\ `) {
+		line = line[:len(line)-1]
+	}
+
+	var p pattern
+	if rest, ok := strings.CutPrefix(line, "!"); ok {
+		p.negate = true
+		line = rest
+	}
+	if rest, ok := strings.CutSuffix(line, "/"); ok {
+		p.dirOnly = true
+		line = rest
+	}
+	if strings.Contains(line, "/") {
+		p.anchored = true
+		line = strings.TrimPrefix(line, "/")
+	}
+	if line == "" {
+		return pattern{}, false
+	}
+
+	// Escape braces, which are literal in ignore files but are alternatives
+	// in doublestar patterns.
+	var sb strings.Builder
+	for i := 0; i < len(line); i++ {
+		switch c := line[i]; c {
+		case '\\':
+			sb.WriteByte(c)
+			if i+1 < len(line) {
+				i++
+				sb.WriteByte(line[i])
+			}
+		case '{', '}':
+			sb.WriteByte('\\')
+			sb.WriteByte(c)
+		default:
+			sb.WriteByte(c)
+		}
+	}
+	p.glob = sb.String()
+	if !doublestar.ValidatePattern(p.glob) {
+		return pattern{}, false
+	}
+	return p, true
+}
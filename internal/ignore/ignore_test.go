@@ -0,0 +1,70 @@
+package ignore_test
+
+import (
+	"testing"
+
+	"github.com/alecthomas/assert/v2"
+
+	"github.com/twpayne/find-duplicates/internal/ignore"
+)
+
+func TestMatcher(t *testing.T) {
+	root := ignore.New(nil, "", []byte(
+		"# comment\n"+
+			"\n"+
+			"*.o\n"+
+			"!keep.o\n"+
+			"build/\n"+
+			"/target\n"+
+			"doc/*.html\n"+
+			"**/cache/**\n"+
+			"trailing  \n"+
+			"\\#hash\n"+
+			"{braces}\r\n",
+	))
+	sub := ignore.New(root, "sub", []byte(
+		"!*.o\n"+
+			"/local\n",
+	))
+	for _, tc := range []struct {
+		relPath  string
+		isDir    bool
+		expected bool
+	}{
+		{relPath: "a.c"},
+		{relPath: "a.o", expected: true},
+		{relPath: "x/y/a.o", expected: true},
+		{relPath: "keep.o"},
+		{relPath: "x/keep.o"},
+		{relPath: "build", isDir: true, expected: true},
+		{relPath: "x/build", isDir: true, expected: true},
+		{relPath: "build"},
+		{relPath: "target", isDir: true, expected: true},
+		{relPath: "target", expected: true},
+		{relPath: "x/target", isDir: true},
+		{relPath: "doc/a.html", expected: true},
+		{relPath: "doc/x/a.html"},
+		{relPath: "x/doc/a.html"},
+		{relPath: "x/cache/a", expected: true},
+		{relPath: "trailing", expected: true},
+		{relPath: "#hash", expected: true},
+		{relPath: "# comment"},
+		{relPath: "{braces}", expected: true},
+		{relPath: "braces"},
+		{relPath: "sub/a.o"},
+		{relPath: "sub/x/a.o"},
+		{relPath: "sub/local", expected: true},
+		{relPath: "sub/x/local"},
+		{relPath: "local"},
+		{relPath: "sub/build", isDir: true, expected: true},
+	} {
+		assert.Equal(t, tc.expected, sub.Match(tc.relPath, tc.isDir), tc.relPath)
+	}
+}
+
+func TestMatcherEmpty(t *testing.T) {
+	root := ignore.New(nil, "", []byte("*.o\n"))
+	assert.Equal(t, root, ignore.New(root, "sub", []byte("# only a comment\n")))
+	var empty *ignore.Matcher
+	assert.False(t, empty.Match("a.o", false))
+}
@@ -0,0 +1,148 @@
+// Package openmetrics implements a minimal writer of the OpenMetrics text
+// format.
+//
+// See https://github.com/prometheus/OpenMetrics/blob/main/specification/OpenMetrics.md.
+package openmetrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// ContentType is the content type of the OpenMetrics text format.
+const ContentType = "application/openmetrics-text; version=1.0.0; charset=utf-8"
+
+// A Label is a label of a sample.
+type Label struct {
+	Name  string
+	Value string
+}
+
+// A Sample is a sample of a counter or gauge.
+type Sample struct {
+	Labels []Label
+	Value  float64
+}
+
+// A Histogram is a sample of a histogram. Buckets are cumulative and must be
+// sorted by upper bound. A final bucket with an upper bound of +Inf and a
+// count of Count is added automatically.
+type Histogram struct {
+	Labels  []Label
+	Buckets []Bucket
+	Count   uint64
+	Sum     float64
+}
+
+// A Bucket is a cumulative bucket in a Histogram.
+type Bucket struct {
+	UpperBound float64
+	Count      uint64
+}
+
+// A Writer writes metric families in the OpenMetrics text format. The first
+// error is returned by Close, and writes after an error are ignored.
+type Writer struct {
+	w   io.Writer
+	err error
+}
+
+// NewWriter returns a new Writer that writes to w.
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{
+		w: w,
+	}
+}
+
+// Close writes the end of the exposition and returns the first error
+// encountered, if any.
+func (w *Writer) Close() error {
+	w.printf("# EOF\n")
+	return w.err
+}
+
+// Counter writes a counter metric family called name with samples.
+func (w *Writer) Counter(name, help string, samples ...Sample) {
+	w.metadata(name, "counter", help)
+	for _, sample := range samples {
+		w.sample(name+"_total", sample.Labels, formatFloat(sample.Value))
+	}
+}
+
+// Gauge writes a gauge metric family called name with samples.
+func (w *Writer) Gauge(name, help string, samples ...Sample) {
+	w.metadata(name, "gauge", help)
+	for _, sample := range samples {
+		w.sample(name, sample.Labels, formatFloat(sample.Value))
+	}
+}
+
+// Histogram writes a histogram metric family called name with histograms.
+func (w *Writer) Histogram(name, help string, histograms ...Histogram) {
+	w.metadata(name, "histogram", help)
+	for _, histogram := range histograms {
+		for _, bucket := range histogram.Buckets {
+			labels := slices.Concat(histogram.Labels, []Label{{Name: "le", Value: formatFloat(bucket.UpperBound)}})
+			w.sample(name+"_bucket", labels, strconv.FormatUint(bucket.Count, 10))
+		}
+		labels := slices.Concat(histogram.Labels, []Label{{Name: "le", Value: "+Inf"}})
+		w.sample(name+"_bucket", labels, strconv.FormatUint(histogram.Count, 10))
+		w.sample(name+"_count", histogram.Labels, strconv.FormatUint(histogram.Count, 10))
+		w.sample(name+"_sum", histogram.Labels, formatFloat(histogram.Sum))
+	}
+}
+
+// metadata writes the metadata of the metric family called name.
+func (w *Writer) metadata(name, typ, help string) {
+	if help != "" {
+		w.printf("# HELP %s %s\n", name, escape(help))
+	}
+	w.printf("# TYPE %s %s\n", name, typ)
+}
+
+// printf writes a formatted string, unless an error has already occurred.
+func (w *Writer) printf(format string, args ...any) {
+	if w.err != nil {
+		return
+	}
+	_, w.err = fmt.Fprintf(w.w, format, args...)
+}
+
+// sample writes a single sample.
+func (w *Writer) sample(name string, labels []Label, value string) {
+	if len(labels) == 0 {
+		w.printf("%s %s\n", name, value)
+		return
+	}
+	formattedLabels := make([]string, 0, len(labels))
+	for _, label := range labels {
+		formattedLabels = append(formattedLabels, label.Name+`="`+escape(label.Value)+`"`)
+	}
+	w.printf("%s{%s} %s\n", name, strings.Join(formattedLabels, ","), value)
+}
+
+// escape escapes backslashes, double quotes, and newlines in s.
+func escape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s)
+}
+
+// formatFloat formats f as an OpenMetrics number.
+func formatFloat(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "+Inf"
+	case math.IsInf(f, -1):
+		return "-Inf"
+	case math.IsNaN(f):
+		return "NaN"
+	case f == math.Trunc(f) && math.Abs(f) < 1e15:
+		// Write integers, such as counts of bytes, without an exponent.
+		return strconv.FormatFloat(f, 'f', -1, 64)
+	default:
+		return strconv.FormatFloat(f, 'g', -1, 64)
+	}
+}
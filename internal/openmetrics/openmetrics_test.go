@@ -0,0 +1,47 @@
+package openmetrics_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/alecthomas/assert/v2"
+
+	"github.com/twpayne/find-duplicates/internal/openmetrics"
+)
+
+func TestWriter(t *testing.T) {
+	var sb strings.Builder
+	w := openmetrics.NewWriter(&sb)
+	w.Counter("files", "Files found.", openmetrics.Sample{Value: 3e9})
+	w.Gauge("queue_depth", "Queue \"depth\".",
+		openmetrics.Sample{Labels: []openmetrics.Label{{Name: "queue", Value: "a"}}, Value: 1},
+		openmetrics.Sample{Labels: []openmetrics.Label{{Name: "queue", Value: "b\\c"}}, Value: 0.5},
+	)
+	w.Histogram("latency_seconds", "", openmetrics.Histogram{
+		Labels: []openmetrics.Label{{Name: "stage", Value: "head"}},
+		Buckets: []openmetrics.Bucket{
+			{UpperBound: 0.001, Count: 1},
+			{UpperBound: 1, Count: 2},
+		},
+		Count: 3,
+		Sum:   12.5,
+	})
+	assert.NoError(t, w.Close())
+	assert.Equal(t, strings.Join([]string{
+		`# HELP files Files found.`,
+		`# TYPE files counter`,
+		`files_total 3000000000`,
+		`# HELP queue_depth Queue \"depth\".`,
+		`# TYPE queue_depth gauge`,
+		`queue_depth{queue="a"} 1`,
+		`queue_depth{queue="b\\c"} 0.5`,
+		`# TYPE latency_seconds histogram`,
+		`latency_seconds_bucket{stage="head",le="0.001"} 1`,
+		`latency_seconds_bucket{stage="head",le="1"} 2`,
+		`latency_seconds_bucket{stage="head",le="+Inf"} 3`,
+		`latency_seconds_count{stage="head"} 3`,
+		`latency_seconds_sum{stage="head"} 12.5`,
+		`# EOF`,
+		``,
+	}, "\n"), sb.String())
+}
@@ -6,19 +6,39 @@ import (
 	"crypto/sha256"
 	"crypto/sha512"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"hash"
+	"math"
 	"os"
+	"os/signal"
+	"path/filepath"
 	"runtime/trace"
 	"strings"
+	"time"
 
-	"github.com/bmatcuk/doublestar/v4"
 	"github.com/spf13/pflag"
 	"github.com/zeebo/xxh3"
 
+	"github.com/twpayne/find-duplicates/internal/action"
 	"github.com/twpayne/find-duplicates/internal/dupfind"
+	"github.com/twpayne/find-duplicates/internal/filter"
+	"github.com/twpayne/find-duplicates/internal/hashcache"
 )
 
+var keepFuncs = map[string]action.KeepFunc{
+	"first":    action.KeepFirst,
+	"newest":   action.KeepNewest,
+	"oldest":   action.KeepOldest,
+	"shortest": action.KeepShortest,
+}
+
+var hardlinkModes = map[string]dupfind.HardlinkMode{
+	"duplicates": dupfind.HardlinkModeDuplicates,
+	"group":      dupfind.HardlinkModeGroup,
+	"hide":       dupfind.HardlinkModeHide,
+}
+
 var hashFuncs = map[string]func() hash.Hash{
 	"sha256": sha256.New,
 	"sha512": sha512.New,
@@ -29,19 +49,74 @@ func run() error {
 	ctx := context.Background()
 
 	// Parse command line arguments.
-	excludePatterns := pflag.StringSliceP("exclude", "x", nil, "exclude patterns")
+	archiveDepth := pflag.Int("archive-depth", 1, "maximum depth of nested archives for --scan-archives")
+	cacheFile := pflag.String("cache", "", "hash cache file")
+	cachePrune := pflag.Bool("cache-prune", false, "prune unused entries from hash cache")
+	dedupe := pflag.String("dedupe", "", "deduplicate with method (reflink)")
+	deleteDuplicates := pflag.Bool("delete", false, "delete duplicates")
+	directories := pflag.Bool("directories", false, "find duplicate directories")
+	dryRun := pflag.Bool("dry-run", false, "print the plan instead of performing actions")
+	var filterRules []filter.Rule
+	pflag.VarP(&ruleFlag{rules: &filterRules, action: filter.Exclude, typ: filter.Glob}, "exclude", "x", "exclude files and directories matching pattern")
+	pflag.Var(&ruleFlag{rules: &filterRules, action: filter.Exclude, typ: filter.Regexp}, "exclude-regex", "exclude files and directories matching regex")
+	followSymlinks := pflag.Bool("follow-symlinks", false, "follow symlinks")
+	ignoreFiles := pflag.StringSlice("ignore-file", nil, "names of ignore files, for example .dupignore")
+	ignoreCase := pflag.Bool("ignore-case", false, "match filter patterns case-insensitively")
+	pflag.Var(&ruleFlag{rules: &filterRules, action: filter.Include, typ: filter.Glob}, "include", "include files and directories matching pattern")
+	pflag.Var(&ruleFlag{rules: &filterRules, action: filter.Include, typ: filter.Regexp}, "include-regex", "include files and directories matching regex")
+	format := pflag.String("format", "json", "output format (json or ndjson)")
+	hardlinks := pflag.String("hardlinks", "duplicates", "how to report hard links (duplicates, group, or hide)")
 	hash := pflag.StringP("hash", "h", "xxhash", "hash to use (sha256, sha512, or xxhash)")
+	keep := pflag.String("keep", "first", "file to keep (first, first-root, newest, oldest, prefix, or shortest)")
 	keepGoing := pflag.BoolP("keep-going", "k", false, "keep going after errors")
+	keepPrefixes := pflag.StringSlice("keep-prefix", nil, "prefixes of files to keep, in priority order")
+	jobs := pflag.IntP("jobs", "j", 0, "maximum number of files to hash concurrently (default 4*GOMAXPROCS)")
+	journalFile := pflag.String("journal", "", "journal file for --move-to")
+	link := pflag.Bool("link", false, "replace duplicates with hard links")
+	maxSize := pflag.String("max-size", "", "maximum file size, for example 1GiB")
+	metricsListen := pflag.String("metrics-listen", "", "serve OpenMetrics on address")
+	minSize := pflag.String("min-size", "", "minimum file size, for example 1MiB")
+	moveTo := pflag.String("move-to", "", "move duplicates to directory")
+	newerThan := pflag.String("newer-than", "", "only files modified within age, for example 30d")
+	olderThan := pflag.String("older-than", "", "only files modified before age, for example 1w")
+	oneFileSystem := pflag.Bool("one-file-system", false, "stay on the file system of each root")
 	threshold := pflag.IntP("threshold", "n", 2, "threshold")
+	rotationalJobs := pflag.Int("rotational-jobs", 1, "maximum number of files to hash concurrently on each rotational disk")
 	output := pflag.StringP("output", "o", "", "output file")
-	printStatistics := pflag.BoolP("statistics", "s", false, "print statistics")
+	progress := pflag.Bool("progress", false, "print progress to stderr")
+	referenceRoots := pflag.StringSlice("reference", nil, "reference roots")
+	respectGitignore := pflag.Bool("respect-gitignore", false, "skip files ignored by .gitignore files")
+	reportSymlinks := pflag.Bool("report-symlinks", false, "report symlinks to duplicates")
+	scanArchives := pflag.Bool("scan-archives", false, "find duplicates in zip and tar archives")
+	statistics := pflag.BoolP("statistics", "s", false, "print statistics")
+	similarity := pflag.Float64("similarity", 0.8, "minimum similarity for similar-dirs")
+	sortOrder := pflag.String("sort", "key", "group order (key or wasted)")
 	traceFile := pflag.String("trace", "", "trace file")
-	pflag.Parse()
+	unique := pflag.Bool("unique", false, "find files without duplicates in other roots")
+	verify := pflag.Bool("verify", false, "verify duplicates byte-by-byte")
+	// Subcommands are only recognized as the first argument, so paths named
+	// similar-dirs or undo can be given after an option or as, for example,
+	// ./undo.
+	args := os.Args[1:]
+	similarDirs := false
+	if len(args) > 0 {
+		switch args[0] {
+		case "similar-dirs":
+			similarDirs = true
+			args = args[1:]
+		case "undo":
+			return runUndo(args[1:])
+		}
+	}
+	if err := pflag.CommandLine.Parse(args); err != nil {
+		return err
+	}
+	args = pflag.Args()
 	var roots []string
-	if pflag.NArg() == 0 {
+	if len(args) == 0 {
 		roots = []string{"."}
 	} else {
-		roots = pflag.Args()
+		roots = args
 	}
 
 	// Create a trace file, if requested.
@@ -57,66 +132,475 @@ func run() error {
 		defer trace.Stop()
 	}
 
-	for _, excludePattern := range *excludePatterns {
-		if !doublestar.ValidatePattern(excludePattern) {
-			return fmt.Errorf("%s: invalid pattern", excludePattern)
+	handleError := func(err error) error {
+		if err == nil || !*keepGoing {
+			return err
 		}
+		fmt.Fprintln(os.Stderr, err)
+		return nil
+	}
+
+	// Determine the action, if any.
+	var actionNames []string
+	switch *dedupe {
+	case "":
+	case "reflink":
+		actionNames = append(actionNames, "reflink")
+	default:
+		return fmt.Errorf("%s: invalid dedupe method", *dedupe)
+	}
+	if *deleteDuplicates {
+		actionNames = append(actionNames, "delete")
+	}
+	if *link {
+		actionNames = append(actionNames, "link")
+	}
+	if *moveTo != "" {
+		actionNames = append(actionNames, "move")
+	}
+	var actionName string
+	switch len(actionNames) {
+	case 0:
+	case 1:
+		actionName = actionNames[0]
+	default:
+		return fmt.Errorf("%s: incompatible actions", strings.Join(actionNames, ", "))
+	}
+	if *directories && actionName != "" {
+		return fmt.Errorf("%s: incompatible with --directories", actionName)
+	}
+	if similarDirs && actionName != "" {
+		return fmt.Errorf("%s: incompatible with similar-dirs", actionName)
+	}
+	if *followSymlinks && actionName != "" {
+		// A path and a symlink to it would be reported as duplicates of
+		// each other, so acting on one could destroy the other.
+		return fmt.Errorf("%s: incompatible with --follow-symlinks", actionName)
+	}
+	if *scanArchives && actionName != "" {
+		// Archive members are not files that can be acted on.
+		return fmt.Errorf("%s: incompatible with --scan-archives", actionName)
+	}
+	if *scanArchives && *archiveDepth < 1 {
+		return fmt.Errorf("%d: invalid archive depth", *archiveDepth)
+	}
+	if *unique && actionName != "" {
+		return fmt.Errorf("%s: incompatible with --unique", actionName)
+	}
+	if *unique && *directories {
+		return errors.New("--directories: incompatible with --unique")
+	}
+	var keepFunc action.KeepFunc
+	switch *keep {
+	case "first-root":
+		keepFunc = action.KeepFirstRoot(roots)
+	case "prefix":
+		if len(*keepPrefixes) == 0 {
+			return errors.New("--keep=prefix requires --keep-prefix")
+		}
+		keepFunc = action.KeepPrefixes(*keepPrefixes)
+	default:
+		var ok bool
+		keepFunc, ok = keepFuncs[*keep]
+		if !ok {
+			return fmt.Errorf("%s: invalid keep rule", *keep)
+		}
+	}
+
+	for i := range filterRules {
+		filterRules[i].IgnoreCase = *ignoreCase
+	}
+	pathFilter, err := filter.New(filterRules...)
+	if err != nil {
+		return err
+	}
+
+	// Open output file.
+	var outputFile *os.File
+	if *output == "" || *output == "-" {
+		outputFile = os.Stdout
+	} else {
+		file, err := os.Create(*output)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		outputFile = file
+	}
+	encoder := json.NewEncoder(outputFile)
+	switch *format {
+	case "json":
+		encoder.SetIndent("", "  ")
+	case "ndjson":
+	default:
+		return fmt.Errorf("%s: invalid format", *format)
+	}
+
+	switch *sortOrder {
+	case "key", "wasted":
+	default:
+		return fmt.Errorf("%s: invalid sort order", *sortOrder)
 	}
 
 	// Find duplicates.
-	hashFunc, ok := hashFuncs[strings.ToLower(*hash)]
+	hashName := strings.ToLower(*hash)
+	hashFunc, ok := hashFuncs[hashName]
 	if !ok {
 		return fmt.Errorf("%s: invalid hash", *hash)
 	}
+	hardlinkMode, ok := hardlinkModes[strings.ToLower(*hardlinks)]
+	if !ok {
+		return fmt.Errorf("%s: invalid hardlink mode", *hardlinks)
+	}
 	options := []dupfind.Option{
-		dupfind.WithHashFunc(hashFunc),
-		dupfind.WithIncludeFunc(func(path string) bool {
-			for _, excludePattern := range *excludePatterns {
-				if doublestar.MatchUnvalidated(excludePattern, path) {
-					return false
-				}
+		dupfind.WithDeviceConcurrency(func(_ uint64, rotational bool) int {
+			if rotational {
+				return *rotationalJobs
 			}
-			return true
+			return math.MaxInt
 		}),
+		dupfind.WithDirectories(*directories),
+		dupfind.WithFollowSymlinks(*followSymlinks),
+		dupfind.WithHardlinkMode(hardlinkMode),
+		dupfind.WithHashFunc(hashFunc),
+		dupfind.WithFilter(pathFilter),
+		dupfind.WithOneFileSystem(*oneFileSystem),
 		dupfind.WithThreshold(*threshold),
+		dupfind.WithReferenceRoots(*referenceRoots...),
+		dupfind.WithReportSymlinks(*reportSymlinks),
 		dupfind.WithRoots(roots...),
+		dupfind.WithVerify(*verify),
+	}
+	if *jobs > 0 {
+		options = append(options, dupfind.WithHashConcurrency(*jobs))
+	}
+	if *scanArchives {
+		options = append(options, dupfind.WithArchiveDepth(*archiveDepth))
+	}
+	if *respectGitignore {
+		options = append(options, dupfind.WithIgnoreFiles(".gitignore"))
+	}
+	options = append(options, dupfind.WithIgnoreFiles(*ignoreFiles...))
+	if *minSize != "" {
+		size, err := parseSize(*minSize)
+		if err != nil {
+			return err
+		}
+		options = append(options, dupfind.WithMinSize(size))
+	}
+	if *maxSize != "" {
+		size, err := parseSize(*maxSize)
+		if err != nil {
+			return err
+		}
+		options = append(options, dupfind.WithMaxSize(size))
+	}
+	if *newerThan != "" {
+		age, err := parseAge(*newerThan)
+		if err != nil {
+			return err
+		}
+		options = append(options, dupfind.WithModifiedSince(time.Now().Add(-age)))
+	}
+	if *olderThan != "" {
+		age, err := parseAge(*olderThan)
+		if err != nil {
+			return err
+		}
+		options = append(options, dupfind.WithModifiedBefore(time.Now().Add(-age)))
+	}
+	if *format == "ndjson" && *sortOrder == "key" && (!*dryRun || actionName == "") {
+		// Stream groups as soon as they are final. Groups sorted by wasted
+		// bytes can only be written once all groups are known. With
+		// --dry-run, only plans are written, as with --format=json.
+		option := dupfind.WithGroupFunc(func(group *dupfind.Group) error {
+			return encoder.Encode(group)
+		})
+		options = append(options, option)
+	}
+	printError := func(err error) {
+		fmt.Fprintln(os.Stderr, err)
+	}
+	if *progress {
+		progressPrinter := newProgressPrinter(os.Stderr)
+		printError = progressPrinter.printError
+		option := dupfind.WithProgressFunc(progressPrinter.interval, progressPrinter.printProgress)
+		options = append(options, option)
 	}
 	if *keepGoing {
 		option := dupfind.WithErrorHandler(func(err error) error {
-			fmt.Fprintln(os.Stderr, err)
+			printError(err)
 			return nil
 		})
 		options = append(options, option)
 	}
+	var cache *hashcache.Cache
+	if *cacheFile != "" {
+		var err error
+		cache, err = hashcache.Open(*cacheFile)
+		if err != nil {
+			return err
+		}
+		options = append(options, dupfind.WithHashCache(cache, hashName))
+	}
 	dupFinder := dupfind.NewDupFinder(options...)
-	result, err := dupFinder.FindDuplicates(ctx)
-	if err != nil {
-		return err
+	// outputErrors returns the paths that were skipped because of errors.
+	// With --keep-going, it is never nil, so that the output always has an
+	// errors property and its shape does not depend on whether any errors
+	// occurred.
+	outputErrors := func() []*dupfind.PathError {
+		pathErrors := dupFinder.Errors()
+		if *keepGoing && pathErrors == nil {
+			pathErrors = []*dupfind.PathError{}
+		}
+		return pathErrors
 	}
-
-	// Write output file.
-	var outputFile *os.File
-	if *output == "" || *output == "-" {
-		outputFile = os.Stdout
-	} else {
-		file, err := os.Create(*output)
+	// Interrupting the search cancels it so that the hashes computed so far
+	// are still saved in the hash cache.
+	ctx, stopSearch := signal.NotifyContext(ctx, os.Interrupt)
+	defer stopSearch()
+	// finishSearch restores the default behavior of interrupts and saves the
+	// hash cache, if any, whether or not the search failed with err.
+	// Unused entries are only pruned after a successful search, as a failed
+	// search might not have reached them.
+	finishSearch := func(err error) error {
+		stopSearch()
+		if cache == nil {
+			return err
+		}
+		if err == nil && *cachePrune {
+			cache.Prune()
+		}
+		return errors.Join(err, cache.Save())
+	}
+	if *metricsListen != "" {
+		stopMetrics, err := serveMetrics(*metricsListen, dupFinder)
 		if err != nil {
 			return err
 		}
-		defer file.Close()
-		outputFile = file
+		defer stopMetrics() //nolint:errcheck
 	}
-	encoder := json.NewEncoder(outputFile)
-	encoder.SetIndent("", "  ")
-	if err := encoder.Encode(result); err != nil {
+	switch {
+	case similarDirs:
+		similarDirectories, err := dupFinder.FindSimilarDirectories(ctx, *similarity)
+		if err := finishSearch(err); err != nil {
+			return err
+		}
+		if err := encodeList(encoder, *format, "similarDirectories", similarDirectories, outputErrors()); err != nil {
+			return err
+		}
+		if *statistics {
+			return printStatistics(dupFinder)
+		}
+		return nil
+	case *unique:
+		uniqueFiles, err := dupFinder.FindUnique(ctx)
+		if err := finishSearch(err); err != nil {
+			return err
+		}
+		if err := encodeList(encoder, *format, "unique", uniqueFiles, outputErrors()); err != nil {
+			return err
+		}
+		if *statistics {
+			return printStatistics(dupFinder)
+		}
+		return nil
+	}
+	result, err := dupFinder.Find(ctx)
+	if err := finishSearch(err); err != nil {
 		return err
 	}
+	if *sortOrder == "wasted" {
+		result.SortByWastedBytes()
+	}
+
+	// Plan actions.
+	plans := make(map[string]*action.Plan)
+	var planKeys []string
+	if actionName != "" {
+		for _, group := range result.Groups {
+			var plan *action.Plan
+			var err error
+			// Plan with the files as they were when they were hashed, so
+			// that files that changed since are not acted on.
+			if len(*referenceRoots) == 0 {
+				plan = action.NewPlan(group.Hash, actionFiles(group.Files), keepFunc)
+			} else {
+				// Never act on files in reference roots.
+				var files, references []dupfind.File
+				for _, file := range group.Files {
+					if file.Reference {
+						references = append(references, file)
+					} else {
+						files = append(files, file)
+					}
+				}
+				plan, err = action.NewReferencePlan(group.Hash, actionFiles(files), actionFiles(references), keepFunc)
+			}
+			if err != nil {
+				if err := handleError(err); err != nil {
+					return err
+				}
+				continue
+			}
+			plans[group.Key] = plan
+			planKeys = append(planKeys, group.Key)
+		}
+	}
+
+	// Write output file. Groups sorted by key are written as a map, otherwise
+	// they are written as a list to preserve their order. Symlinks to
+	// duplicates are written in a symlinks section indexed by key, and paths
+	// that were skipped because of errors are written in an errors section.
+	var duplicates any = result.Map()
+	if *sortOrder != "key" {
+		duplicates = result
+	}
+	var symlinks map[string][]string
+	if *reportSymlinks {
+		symlinks = make(map[string][]string)
+	}
+	for _, group := range result.Groups {
+		if len(group.Symlinks) > 0 {
+			symlinks[group.Key] = group.Symlinks
+		}
+	}
+	pathErrors := outputErrors()
+	switch {
+	case *format == "ndjson" && *dryRun && actionName != "":
+		for _, key := range planKeys {
+			if err := encoder.Encode(struct {
+				Action string `json:"action"`
+				*action.Plan
+			}{
+				Action: actionName,
+				Plan:   plans[key],
+			}); err != nil {
+				return err
+			}
+		}
+		if err := encodeErrorLines(encoder, pathErrors); err != nil {
+			return err
+		}
+	case *format == "ndjson":
+		// Groups sorted by key have already been written.
+		if *sortOrder != "key" {
+			for _, group := range result.Groups {
+				if err := encoder.Encode(group); err != nil {
+					return err
+				}
+			}
+		}
+		for _, paths := range dupFinder.Hardlinks() {
+			if err := encoder.Encode(struct {
+				Hardlinks []string `json:"hardlinks"`
+			}{
+				Hardlinks: paths,
+			}); err != nil {
+				return err
+			}
+		}
+		if err := encodeErrorLines(encoder, pathErrors); err != nil {
+			return err
+		}
+	case *dryRun && actionName != "":
+		if err := encoder.Encode(struct {
+			Action string                  `json:"action"`
+			Plans  map[string]*action.Plan `json:"plans"`
+			Errors []*dupfind.PathError    `json:"errors,omitzero"`
+		}{
+			Action: actionName,
+			Plans:  plans,
+			Errors: pathErrors,
+		}); err != nil {
+			return err
+		}
+	case hardlinkMode == dupfind.HardlinkModeGroup:
+		if err := encoder.Encode(struct {
+			Duplicates any                  `json:"duplicates"`
+			Hardlinks  [][]string           `json:"hardlinks"`
+			Symlinks   map[string][]string  `json:"symlinks,omitzero"`
+			Errors     []*dupfind.PathError `json:"errors,omitzero"`
+		}{
+			Duplicates: duplicates,
+			Hardlinks:  dupFinder.Hardlinks(),
+			Symlinks:   symlinks,
+			Errors:     pathErrors,
+		}); err != nil {
+			return err
+		}
+	case symlinks != nil || pathErrors != nil:
+		if err := encoder.Encode(struct {
+			Duplicates any                  `json:"duplicates"`
+			Symlinks   map[string][]string  `json:"symlinks,omitzero"`
+			Errors     []*dupfind.PathError `json:"errors,omitzero"`
+		}{
+			Duplicates: duplicates,
+			Symlinks:   symlinks,
+			Errors:     pathErrors,
+		}); err != nil {
+			return err
+		}
+	default:
+		if err := encoder.Encode(duplicates); err != nil {
+			return err
+		}
+	}
+
+	// Perform actions.
+	if !*dryRun {
+		var journal *action.Journal
+		if actionName == "move" {
+			if err := os.MkdirAll(*moveTo, 0o777); err != nil {
+				return err
+			}
+			if *journalFile == "" {
+				*journalFile = filepath.Join(*moveTo, "find-duplicates-"+time.Now().UTC().Format("20060102T150405Z")+".journal")
+			}
+			var err error
+			journal, err = action.CreateJournal(*journalFile)
+			if err != nil {
+				return err
+			}
+			defer journal.Close()
+		}
+		var reflinkReport struct {
+			BytesReclaimed      int64            `json:"bytesReclaimed"`
+			GroupBytesReclaimed map[string]int64 `json:"groupBytesReclaimed"`
+		}
+		reflinkReport.GroupBytesReclaimed = make(map[string]int64, len(plans))
+		for _, key := range planKeys {
+			plan := plans[key]
+			var err error
+			switch actionName {
+			case "delete":
+				err = action.Delete(plan, hashFunc)
+			case "link":
+				err = action.Link(plan, hashFunc)
+			case "move":
+				err = action.Move(plan, *moveTo, journal, hashFunc)
+			case "reflink":
+				var bytesReclaimed int64
+				bytesReclaimed, err = action.Reflink(plan)
+				reflinkReport.BytesReclaimed += bytesReclaimed
+				reflinkReport.GroupBytesReclaimed[key] = bytesReclaimed
+			}
+			if err := handleError(err); err != nil {
+				return err
+			}
+		}
+		if actionName == "reflink" {
+			encoder := json.NewEncoder(os.Stderr)
+			encoder.SetIndent("", "  ")
+			if err := encoder.Encode(reflinkReport); err != nil {
+				return err
+			}
+		}
+	}
 
 	// Print statistics.
-	if *printStatistics {
-		encoder := json.NewEncoder(os.Stderr)
-		encoder.SetIndent("", "  ")
-		if err := encoder.Encode(dupFinder.Statistics()); err != nil {
+	if *statistics {
+		if err := printStatistics(dupFinder); err != nil {
 			return err
 		}
 	}
@@ -124,6 +608,82 @@ func run() error {
 	return nil
 }
 
+// actionFiles returns files as action.Files.
+func actionFiles(files []dupfind.File) []action.File {
+	actionFiles := make([]action.File, 0, len(files))
+	for _, file := range files {
+		actionFiles = append(actionFiles, action.File{
+			Path:    file.Path,
+			Size:    file.Size,
+			Mode:    file.Mode,
+			ModTime: file.ModTime,
+			Dev:     file.Dev,
+			Ino:     file.Ino,
+		})
+	}
+	return actionFiles
+}
+
+// encodeErrorLines encodes each of pathErrors with encoder on its own line
+// with an error property.
+func encodeErrorLines(encoder *json.Encoder, pathErrors []*dupfind.PathError) error {
+	for _, pathError := range pathErrors {
+		if err := encoder.Encode(struct {
+			Error *dupfind.PathError `json:"error"`
+		}{
+			Error: pathError,
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// encodeList encodes items with encoder as a JSON array or, if format is
+// ndjson, as one JSON value per line. If pathErrors is not nil then the JSON
+// array is written as the name property of an object with an errors property,
+// or each error is written on its own line.
+func encodeList[T any](encoder *json.Encoder, format, name string, items []T, pathErrors []*dupfind.PathError) error {
+	if format != "ndjson" {
+		if items == nil {
+			items = []T{}
+		}
+		if pathErrors == nil {
+			return encoder.Encode(items)
+		}
+		return encoder.Encode(map[string]any{
+			name:     items,
+			"errors": pathErrors,
+		})
+	}
+	for _, item := range items {
+		if err := encoder.Encode(item); err != nil {
+			return err
+		}
+	}
+	return encodeErrorLines(encoder, pathErrors)
+}
+
+// printStatistics prints dupFinder's statistics to stderr.
+func printStatistics(dupFinder *dupfind.DupFinder) error {
+	encoder := json.NewEncoder(os.Stderr)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(dupFinder.Statistics())
+}
+
+// runUndo undoes the moves recorded in the journal in args.
+func runUndo(args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: find-duplicates undo <journal>")
+	}
+	journalFile, err := os.Open(args[0])
+	if err != nil {
+		return err
+	}
+	defer journalFile.Close()
+	return action.Undo(journalFile)
+}
+
 func main() {
 	if err := run(); err != nil {
 		fmt.Fprintln(os.Stderr, err)
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/twpayne/find-duplicates/internal/dupfind"
+	"github.com/twpayne/find-duplicates/internal/openmetrics"
+)
+
+// serveMetrics serves dupFinder's metrics in the OpenMetrics text format on
+// address at /metrics. It returns a function that stops the server.
+func serveMetrics(address string, dupFinder *dupfind.DupFinder) (func() error, error) {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	serveMux := http.NewServeMux()
+	serveMux.HandleFunc("GET /metrics", func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", openmetrics.ContentType)
+		_ = writeMetrics(w, dupFinder.Metrics())
+	})
+	server := &http.Server{
+		Handler:           serveMux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		if err := server.Serve(listener); !errors.Is(err, http.ErrServerClosed) {
+			fmt.Fprintln(os.Stderr, err)
+		}
+	}()
+	return server.Close, nil
+}
+
+// writeMetrics writes metrics to w in the OpenMetrics text format.
+func writeMetrics(w io.Writer, metrics *dupfind.Metrics) error {
+	openMetricsWriter := openmetrics.NewWriter(w)
+	counter := func(name, help string, value uint64) {
+		openMetricsWriter.Counter("find_duplicates_"+name, help, openmetrics.Sample{
+			Value: float64(value),
+		})
+	}
+	statistics := metrics.Statistics
+	counter("errors", "Number of errors.", statistics.Errors)
+	counter("dir_entries", "Number of directory entries walked.", statistics.DirEntries)
+	counter("files", "Number of regular files found.", statistics.Files)
+	counter("files_opened", "Number of files opened.", statistics.FilesOpened)
+	counter("file_bytes", "Total size of regular files found in bytes.", statistics.TotalBytes)
+	counter("hashed_bytes", "Number of bytes read and hashed.", statistics.BytesHashed)
+	counter("unique_sizes", "Number of unique file sizes.", statistics.UniqueSizes)
+	counter("hash_collisions", "Number of files with identical hashes but different contents.", statistics.Collisions)
+	counter("cache_hits", "Number of hash cache hits.", statistics.CacheHits)
+	counter("cache_misses", "Number of hash cache misses.", statistics.CacheMisses)
+	counter("hardlinks", "Number of hard links to files already found.", statistics.Hardlinks)
+
+	stages := []struct {
+		name       string
+		statistics dupfind.StageStatistics
+	}{
+		{name: "head", statistics: statistics.Head},
+		{name: "tail", statistics: statistics.Tail},
+		{name: "full", statistics: statistics.Full},
+	}
+	stageCounter := func(name, help string, value func(dupfind.StageStatistics) uint64) {
+		samples := make([]openmetrics.Sample, 0, len(stages))
+		for _, stage := range stages {
+			samples = append(samples, openmetrics.Sample{
+				Labels: []openmetrics.Label{{Name: "stage", Value: stage.name}},
+				Value:  float64(value(stage.statistics)),
+			})
+		}
+		openMetricsWriter.Counter("find_duplicates_stage_"+name, help, samples...)
+	}
+	stageCounter("files_hashed", "Number of files hashed by each stage.", func(s dupfind.StageStatistics) uint64 {
+		return s.FilesHashed
+	})
+	stageCounter("hashed_bytes", "Number of bytes hashed by each stage.", func(s dupfind.StageStatistics) uint64 {
+		return s.BytesHashed
+	})
+	stageCounter("files_eliminated", "Number of files eliminated by each stage.", func(s dupfind.StageStatistics) uint64 {
+		return s.FilesEliminated
+	})
+	stageCounter("saved_bytes", "Number of bytes not read because of each stage.", func(s dupfind.StageStatistics) uint64 {
+		return s.BytesSaved
+	})
+
+	queueDepths := make([]openmetrics.Sample, 0, len(metrics.Queues))
+	queueCapacities := make([]openmetrics.Sample, 0, len(metrics.Queues))
+	for _, queue := range metrics.Queues {
+		labels := []openmetrics.Label{{Name: "queue", Value: queue.Name}}
+		queueDepths = append(queueDepths, openmetrics.Sample{
+			Labels: labels,
+			Value:  float64(queue.Depth),
+		})
+		queueCapacities = append(queueCapacities, openmetrics.Sample{
+			Labels: labels,
+			Value:  float64(queue.Capacity),
+		})
+	}
+	openMetricsWriter.Gauge("find_duplicates_queue_depth", "Number of items in each queue between stages.", queueDepths...)
+	openMetricsWriter.Gauge("find_duplicates_queue_capacity", "Capacity of each queue between stages.", queueCapacities...)
+
+	histograms := make([]openmetrics.Histogram, 0, len(metrics.HashLatency))
+	for _, latencyHistogram := range metrics.HashLatency {
+		histogram := openmetrics.Histogram{
+			Labels: []openmetrics.Label{{Name: "stage", Value: latencyHistogram.Stage}},
+			Count:  latencyHistogram.Count,
+			Sum:    latencyHistogram.Sum.Seconds(),
+		}
+		for _, bucket := range latencyHistogram.Buckets {
+			if bucket.UpperBound == 0 {
+				continue
+			}
+			histogram.Buckets = append(histogram.Buckets, openmetrics.Bucket{
+				UpperBound: bucket.UpperBound.Seconds(),
+				Count:      bucket.Count,
+			})
+		}
+		histograms = append(histograms, histogram)
+	}
+	openMetricsWriter.Histogram("find_duplicates_hash_latency_seconds", "Time taken to open, read, and hash each file.", histograms...)
+
+	return openMetricsWriter.Close()
+}
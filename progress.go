@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/twpayne/find-duplicates/internal/dupfind"
+)
+
+// Progress intervals.
+const (
+	progressIntervalTTY  = 200 * time.Millisecond
+	progressIntervalJSON = 10 * time.Second
+)
+
+// A progressPrinter prints progress to a file. If the file is a terminal then
+// progress is printed as a status line that is redrawn in place, otherwise it
+// is printed as one JSON object per line.
+type progressPrinter struct {
+	mutex    sync.Mutex
+	file     *os.File
+	tty      bool
+	interval time.Duration
+	encoder  *json.Encoder
+	line     bool
+}
+
+// newProgressPrinter returns a new progressPrinter that prints to file.
+func newProgressPrinter(file *os.File) *progressPrinter {
+	p := &progressPrinter{
+		file:     file,
+		interval: progressIntervalJSON,
+		encoder:  json.NewEncoder(file),
+	}
+	if isTerminal(file) {
+		p.tty = true
+		p.interval = progressIntervalTTY
+	}
+	return p
+}
+
+// clearLine clears the status line, if any. p.mutex must be held.
+func (p *progressPrinter) clearLine() {
+	if p.line {
+		fmt.Fprint(p.file, "\r\x1b[K")
+		p.line = false
+	}
+}
+
+// printError prints err on its own line, clearing the status line first.
+func (p *progressPrinter) printError(err error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.clearLine()
+	fmt.Fprintln(p.file, err)
+}
+
+// printProgress prints progress.
+func (p *progressPrinter) printProgress(progress *dupfind.Progress) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if !p.tty {
+		_ = p.encoder.Encode(struct {
+			*dupfind.Progress
+			Elapsed float64 `json:"elapsed"`
+			ETA     float64 `json:"eta"`
+		}{
+			Progress: progress,
+			Elapsed:  progress.Elapsed.Seconds(),
+			ETA:      progress.ETA.Seconds(),
+		})
+		return
+	}
+	var eta string
+	switch {
+	case progress.Done:
+		eta = "done in " + progress.Elapsed.Round(time.Second).String()
+	case progress.ETA > 0:
+		eta = "ETA " + progress.ETA.Round(time.Second).String()
+	default:
+		eta = "ETA unknown"
+	}
+	p.clearLine()
+	fmt.Fprintf(p.file, "%d files walked, %d candidates, %s of %s hashed, %s/s, %s",
+		progress.FilesWalked,
+		progress.Candidates,
+		formatBytes(float64(progress.BytesHashed)),
+		formatBytes(float64(progress.BytesQueued)),
+		formatBytes(progress.BytesPerSecond),
+		eta,
+	)
+	p.line = true
+	if progress.Done {
+		fmt.Fprintln(p.file)
+		p.line = false
+	}
+}
+
+// formatBytes formats n bytes with a binary prefix.
+func formatBytes(n float64) string {
+	units := []string{"B", "KiB", "MiB", "GiB", "TiB", "PiB", "EiB"}
+	i := 0
+	for n >= 1024 && i < len(units)-1 {
+		n /= 1024
+		i++
+	}
+	if i == 0 {
+		return fmt.Sprintf("%.0f %s", n, units[i])
+	}
+	return fmt.Sprintf("%.1f %s", n, units[i])
+}
@@ -0,0 +1,34 @@
+package main
+
+import "github.com/twpayne/find-duplicates/internal/filter"
+
+// A ruleFlag is a flag that appends a filter rule to rules each time it is
+// set, so that rules from different flags keep their command line order.
+type ruleFlag struct {
+	rules  *[]filter.Rule
+	action filter.Action
+	typ    filter.Type
+}
+
+// Set implements [github.com/spf13/pflag.Value.Set].
+func (f *ruleFlag) Set(pattern string) error {
+	*f.rules = append(*f.rules, filter.Rule{
+		Action:  f.action,
+		Type:    f.typ,
+		Pattern: pattern,
+	})
+	return nil
+}
+
+// String implements [github.com/spf13/pflag.Value.String].
+func (f *ruleFlag) String() string {
+	return ""
+}
+
+// Type implements [github.com/spf13/pflag.Value.Type].
+func (f *ruleFlag) Type() string {
+	if f.typ == filter.Regexp {
+		return "regex"
+	}
+	return "pattern"
+}
@@ -0,0 +1,11 @@
+//go:build !unix
+
+package main
+
+import "os"
+
+// isTerminal returns whether file is a terminal. It is only implemented on
+// Unix, so file is never a terminal on other systems.
+func isTerminal(*os.File) bool {
+	return false
+}
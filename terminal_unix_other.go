@@ -0,0 +1,8 @@
+//go:build unix && !darwin && !dragonfly && !freebsd && !ios && !netbsd && !openbsd
+
+package main
+
+import "golang.org/x/sys/unix"
+
+// ioctlReadTermios is the ioctl request that reads a terminal's attributes.
+const ioctlReadTermios = unix.TCGETS
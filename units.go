@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ageComponentRx matches a number with an optional unit in an age.
+var ageComponentRx = regexp.MustCompile(`[0-9.]+[^0-9.]*`)
+
+// ageUnits are the units of ages that are not understood by
+// [time.ParseDuration].
+var ageUnits = map[string]time.Duration{
+	"d": 24 * time.Hour,
+	"w": 7 * 24 * time.Hour,
+}
+
+// sizeUnits are the multipliers of size units, indexed by their lowercase
+// names. Single letter units are binary, as in du and find.
+var sizeUnits = map[string]float64{
+	"":    1,
+	"b":   1,
+	"k":   1 << 10,
+	"kb":  1e3,
+	"kib": 1 << 10,
+	"m":   1 << 20,
+	"mb":  1e6,
+	"mib": 1 << 20,
+	"g":   1 << 30,
+	"gb":  1e9,
+	"gib": 1 << 30,
+	"t":   1 << 40,
+	"tb":  1e12,
+	"tib": 1 << 40,
+}
+
+// parseAge parses an age, which is a sequence of numbers with units, for
+// example 30d, 2w, or 1d12h. Units are days (d), weeks (w), and the units
+// accepted by [time.ParseDuration].
+func parseAge(s string) (time.Duration, error) {
+	components := ageComponentRx.FindAllString(s, -1)
+	if len(components) == 0 || strings.Join(components, "") != s {
+		return 0, fmt.Errorf("%s: invalid age", s)
+	}
+	var age time.Duration
+	for _, component := range components {
+		var duration time.Duration
+		number, unit := splitUnit(component)
+		if multiplier, ok := ageUnits[unit]; ok {
+			value, err := strconv.ParseFloat(number, 64)
+			if err != nil || value*float64(multiplier) > math.MaxInt64 {
+				return 0, fmt.Errorf("%s: invalid age", s)
+			}
+			duration = time.Duration(value * float64(multiplier))
+		} else {
+			var err error
+			duration, err = time.ParseDuration(component)
+			if err != nil {
+				return 0, fmt.Errorf("%s: invalid age", s)
+			}
+		}
+		if age > math.MaxInt64-duration {
+			return 0, fmt.Errorf("%s: invalid age", s)
+		}
+		age += duration
+	}
+	return age, nil
+}
+
+// parseSize parses a size in bytes with an optional unit, for example 1MiB or
+// 1.5GB.
+func parseSize(s string) (int64, error) {
+	number, unit := splitUnit(s)
+	value, err := strconv.ParseFloat(number, 64)
+	multiplier, ok := sizeUnits[strings.ToLower(unit)]
+	if err != nil || !ok || value < 0 || value*multiplier > math.MaxInt64 {
+		return 0, fmt.Errorf("%s: invalid size", s)
+	}
+	return int64(value * multiplier), nil
+}
+
+// splitUnit splits s into a number and a unit.
+func splitUnit(s string) (string, string) {
+	i := strings.LastIndexAny(s, "0123456789.") + 1
+	return s[:i], s[i:]
+}
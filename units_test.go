@@ -0,0 +1,102 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/alecthomas/assert/v2"
+)
+
+func TestParseAge(t *testing.T) {
+	for _, tc := range []struct {
+		s        string
+		expected time.Duration
+	}{
+		{s: "0", expected: 0},
+		{s: "90s", expected: 90 * time.Second},
+		{s: "12h", expected: 12 * time.Hour},
+		{s: "1.5h", expected: 90 * time.Minute},
+		{s: "30d", expected: 30 * 24 * time.Hour},
+		{s: "0.5d", expected: 12 * time.Hour},
+		{s: "2w", expected: 14 * 24 * time.Hour},
+		{s: "1d12h", expected: 36 * time.Hour},
+		{s: "1w2d", expected: 9 * 24 * time.Hour},
+		{s: "1h30m", expected: 90 * time.Minute},
+		{s: "1d1h1m1s", expected: 25*time.Hour + time.Minute + time.Second},
+	} {
+		t.Run(tc.s, func(t *testing.T) {
+			actual, err := parseAge(tc.s)
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expected, actual)
+		})
+	}
+}
+
+func TestParseAgeInvalid(t *testing.T) {
+	for _, s := range []string{
+		"",
+		"d",
+		"1",
+		"-1d",
+		"-1h",
+		"1x",
+		"1D",
+		"1.2.3d",
+		"1d-12h",
+		"d12h",
+		"1d 12h",
+		"1000000w",
+	} {
+		t.Run(s, func(t *testing.T) {
+			_, err := parseAge(s)
+			assert.EqualError(t, err, s+": invalid age")
+		})
+	}
+}
+
+func TestParseSize(t *testing.T) {
+	for _, tc := range []struct {
+		s        string
+		expected int64
+	}{
+		{s: "0", expected: 0},
+		{s: "100", expected: 100},
+		{s: "100b", expected: 100},
+		{s: "1k", expected: 1 << 10},
+		{s: "1kB", expected: 1000},
+		{s: "1KiB", expected: 1 << 10},
+		{s: "1M", expected: 1 << 20},
+		{s: "1MB", expected: 1000 * 1000},
+		{s: "1MiB", expected: 1 << 20},
+		{s: "1.5G", expected: 3 << 29},
+		{s: "1GB", expected: 1000 * 1000 * 1000},
+		{s: "1gib", expected: 1 << 30},
+		{s: "2T", expected: 2 << 40},
+		{s: "2TB", expected: 2 * 1000 * 1000 * 1000 * 1000},
+		{s: "2TiB", expected: 2 << 40},
+	} {
+		t.Run(tc.s, func(t *testing.T) {
+			actual, err := parseSize(tc.s)
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expected, actual)
+		})
+	}
+}
+
+func TestParseSizeInvalid(t *testing.T) {
+	for _, s := range []string{
+		"",
+		"k",
+		"-1",
+		"1x",
+		"1PB",
+		"1.2.3M",
+		"1 MB",
+		"10000000TB",
+	} {
+		t.Run(s, func(t *testing.T) {
+			_, err := parseSize(s)
+			assert.EqualError(t, err, s+": invalid size")
+		})
+	}
+}